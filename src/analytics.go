@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+	"sort"
+	"time"
+)
+
+// Acquisition keeps what a release offered for a removed media looked like, without
+// its title or the media it was for.
+type Acquisition struct {
+	ID         uint64    `boltholdKey:"ID" json:"id"`
+	Movie      bool      `json:"movie"`
+	Resolution string    `json:"resolution"`
+	Source     string    `json:"source"`
+	Size       int64     `json:"size"`
+	Failed     bool      `json:"failed"`
+	Chosen     bool      `json:"chosen"`
+	RemovedAt  time.Time `json:"removed_at"`
+}
+
+type AcquisitionGroup struct {
+	Resolution string `json:"resolution"`
+	Source     string `json:"source"`
+	Candidates int    `json:"candidates"`
+	Chosen     int    `json:"chosen"`
+	Failed     int    `json:"failed"`
+}
+
+// recordAcquisitions saves the NZBs of media before they are deleted with it. The last
+// release sent to SABnzbd is the chosen one.
+func (app App) recordAcquisitions(media Media) error {
+	var nzbs []NZB
+	if err := app.Store.Find(&nzbs, bolthold.Where("Trakt").Eq(media.Trakt).Index("Trakt")); err != nil {
+		return fmt.Errorf("finding NZBs for %d: %v", media.Trakt, err)
+	}
+	var chosen string
+	if len(media.TriedReleases) > 0 {
+		chosen = media.TriedReleases[len(media.TriedReleases)-1]
+	}
+	now := time.Now()
+	for _, nzb := range nzbs {
+		resolution, source := parseRelease(nzb.Title)
+		acquisition := Acquisition{
+			Movie:      media.IsMovie(),
+			Resolution: resolution,
+			Source:     source,
+			Size:       nzb.Length,
+			Failed:     nzb.Failed,
+			Chosen:     chosen != "" && nzb.GUID == chosen,
+			RemovedAt:  now,
+		}
+		if err := app.Store.Insert(bolthold.NextSequence(), &acquisition); err != nil {
+			return fmt.Errorf("saving acquisition: %v", err)
+		}
+	}
+	return nil
+}
+
+func (app App) acquisitionStats() ([]AcquisitionGroup, error) {
+	var acquisitions []Acquisition
+	if err := app.Store.Find(&acquisitions, &bolthold.Query{}); err != nil {
+		return nil, fmt.Errorf("finding acquisitions: %v", err)
+	}
+	groups := make(map[[2]string]*AcquisitionGroup)
+	for _, acquisition := range acquisitions {
+		key := [2]string{acquisition.Resolution, acquisition.Source}
+		group, ok := groups[key]
+		if !ok {
+			group = &AcquisitionGroup{Resolution: acquisition.Resolution, Source: acquisition.Source}
+			groups[key] = group
+		}
+		group.Candidates++
+		if acquisition.Chosen {
+			group.Chosen++
+		}
+		if acquisition.Failed {
+			group.Failed++
+		}
+	}
+	stats := make([]AcquisitionGroup, 0, len(groups))
+	for _, group := range groups {
+		stats = append(stats, *group)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Chosen > stats[j].Chosen
+	})
+	return stats, nil
+}
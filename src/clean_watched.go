@@ -1,55 +1,212 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/amaumene/momenarr/bolthold"
 	"github.com/amaumene/momenarr/trakt"
 	"github.com/amaumene/momenarr/trakt/sync"
+	log "github.com/sirupsen/logrus"
 	"os"
+	"sort"
 	"time"
 )
 
-func (app App) cleanWatched() error {
+// cleanWatched removes the medias watched recently and returns how many it removed.
+func (app App) cleanWatched() (int, error) {
 	params := trakt.ListParams{OAuth: app.TraktToken.AccessToken}
 
 	historyParams := &trakt.ListHistoryParams{
 		ListParams: params,
 		EndAt:      time.Now(),
-		StartAt:    time.Now().AddDate(0, 0, -5),
+		StartAt:    time.Now().Add(-app.Config().HistoryWindow),
 	}
+	var watched []int64
 	iterator := sync.History(historyParams)
-	for iterator.Next() {
+	for scanned := 0; app.timedNext("trakt.History", iterator); scanned++ {
+		if app.Config().HistoryMaxItems > 0 && scanned >= app.Config().HistoryMaxItems {
+			log.WithFields(log.Fields{
+				"max_items": app.Config().HistoryMaxItems,
+			}).Info("Reached CLEANUP_HISTORY_MAX_ITEMS, older history is cleaned on the next run")
+			break
+		}
 		item, err := iterator.History()
 		if err != nil {
-			return fmt.Errorf("scanning watch history: %v", err)
+			return 0, fmt.Errorf("scanning watch history: %v", err)
 		}
 
-		switch item.Type.String() {
-		case "movie":
-			err = app.removeMedia(int64(item.Movie.Trakt))
-			if err != nil {
-				return fmt.Errorf("removing movie: %v", err)
-			}
-		case "episode":
-			err = app.removeMedia(int64(item.Episode.Trakt))
-			if err != nil {
-				return fmt.Errorf("removing episode: %v", err)
+		switch item.Type {
+		case trakt.TypeMovie:
+			watched = append(watched, int64(item.Movie.Trakt))
+		case trakt.TypeEpisode:
+			if item.Show != nil && app.watchedBeforeReset(int64(item.Show.Trakt), item.WatchedAt) {
+				continue
 			}
+			watched = append(watched, int64(item.Episode.Trakt))
 		}
 	}
 	if err := iterator.Err(); err != nil {
-		return fmt.Errorf("iterating watch history: %v", err)
+		return 0, fmt.Errorf("iterating watch history: %v", err)
+	}
+	if err := app.markWatched(watched, time.Now()); err != nil {
+		return 0, err
+	}
+	return app.removeWatched()
+}
+
+// markWatched records when the medias were first seen in the watch history, so the ones
+// kept for now are still cleaned once they are older than CLEANUP_HISTORY_WINDOW.
+func (app App) markWatched(watched []int64, at time.Time) error {
+	for _, Trakt := range watched {
+		var media Media
+		err := app.Store.Get(Trakt, &media)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("finding %d in database: %v", Trakt, err)
+		}
+		if !media.WatchedAt.IsZero() {
+			continue
+		}
+		media.WatchedAt = at
+		if err := app.Store.Update(Trakt, media); err != nil {
+			return fmt.Errorf("marking %d as watched: %v", Trakt, err)
+		}
 	}
 	return nil
 }
 
+// removeWatched removes the medias marked as watched and returns how many it removed.
+func (app App) removeWatched() (int, error) {
+	var medias []Media
+	if err := app.Store.Find(&medias, bolthold.Where("WatchedAt").Gt(time.Time{})); err != nil {
+		return 0, fmt.Errorf("finding watched medias: %v", err)
+	}
+	var watched []int64
+	for _, media := range medias {
+		watched = append(watched, media.Trakt)
+	}
+
+	if app.Config().CleanupFreeSpaceTarget > 0 {
+		return app.removeUntilFreeSpace(watched)
+	}
+	cleaned := 0
+	for _, Trakt := range watched {
+		err := app.removeWatchedMedia(Trakt)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return cleaned, fmt.Errorf("removing media: %v", err)
+		}
+		cleaned++
+	}
+	return cleaned, nil
+}
+
+// diskFreeSpace is freeSpace, replaced in tests.
+var diskFreeSpace = freeSpace
+
+// removeUntilFreeSpace removes the biggest watched medias first, as long as the directory
+// each one is in has less than CLEANUP_FREE_SPACE_GB available. The others are kept until
+// space is needed again. It returns how many medias were removed.
+func (app App) removeUntilFreeSpace(watched []int64) (int, error) {
+	var medias []Media
+	for _, Trakt := range watched {
+		var media Media
+		if err := app.Store.Get(Trakt, &media); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return 0, fmt.Errorf("finding %d in database: %v", Trakt, err)
+		}
+		medias = append(medias, media)
+	}
+	sizes := make(map[int64]int64, len(medias))
+	for _, media := range medias {
+		if info, err := os.Stat(media.File); err == nil {
+			sizes[media.Trakt] = info.Size()
+		}
+	}
+	sort.SliceStable(medias, func(i, j int) bool {
+		return sizes[medias[i].Trakt] > sizes[medias[j].Trakt]
+	})
+
+	removed, kept := 0, 0
+	for _, media := range medias {
+		dir := app.Config().downloadDirFor(media)
+		free, err := diskFreeSpace(dir)
+		if err != nil {
+			return removed, fmt.Errorf("getting free space of %s: %v", dir, err)
+		}
+		if free >= app.Config().CleanupFreeSpaceTarget {
+			kept++
+			continue
+		}
+		err = app.removeWatchedMedia(media.Trakt)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("removing media: %v", err)
+		}
+		removed++
+	}
+	if kept > 0 {
+		log.WithFields(log.Fields{
+			"target": app.Config().CleanupFreeSpaceTarget,
+			"kept":   kept,
+		}).Info("Enough free space, keeping remaining watched medias")
+	}
+	return removed, nil
+}
+
+// watchedBeforeReset reports whether an episode of show watched at watchedAt was watched
+// before the show's progress was reset on Trakt, in which case it is being rewatched and
+// must be kept.
+func (app App) watchedBeforeReset(show int64, watchedAt time.Time) bool {
+	var progress ShowProgress
+	if err := app.Store.Get(show, &progress); err != nil {
+		return false
+	}
+	return watchedAt.Before(progress.ResetAt)
+}
+
+func (app App) removeWatchedMedia(Trakt int64) error {
+	if app.Config().CleanupMode == "archive" {
+		return app.archiveMedia(Trakt)
+	}
+	return app.removeMedia(Trakt)
+}
+
+func (app App) archiveMedia(Trakt int64) error {
+	var media Media
+	err := app.Store.Get(Trakt, &media)
+	if err != nil {
+		return fmt.Errorf("finding %d in database: %w", Trakt, err)
+	}
+
+	archived := ArchivedMedia{Media: media, ArchivedAt: time.Now()}
+	err = app.Store.Upsert(Trakt, archived)
+	if err != nil {
+		return fmt.Errorf("archiving %d: %v", Trakt, err)
+	}
+	return app.removeMedia(Trakt)
+}
+
 func (app App) removeMedia(Trakt int64) error {
 	var media Media
 	err := app.Store.Get(Trakt, &media)
 	if err != nil {
-		return fmt.Errorf("finding %d in database: %v", Trakt, err)
+		return fmt.Errorf("finding %d in database: %w", Trakt, err)
 	}
 
+	if app.Config().RetainAcquisitions {
+		if err := app.recordAcquisitions(media); err != nil {
+			return err
+		}
+	}
 	err = app.Store.Delete(Trakt, &media)
 	if err != nil {
 		return fmt.Errorf("deleting database entry for %d: %v", Trakt, err)
@@ -65,5 +222,6 @@ func (app App) removeMedia(Trakt int64) error {
 		return fmt.Errorf("deleting %s: %v", media.File, err)
 	}
 
+	app.emit(EventMediaDeleted, media, "")
 	return nil
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// seedWatched stores a watched movie for each size, its file in dir, and returns the files.
+func seedWatched(t *testing.T, app App, dir string, watchedAt time.Time, sizes ...int) []string {
+	t.Helper()
+	var files []string
+	for i, size := range sizes {
+		file := filepath.Join(dir, fmt.Sprintf("%d.mkv", i+1))
+		if err := os.WriteFile(file, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		Trakt := int64(i + 1)
+		if err := app.Store.Insert(Trakt, Media{Trakt: Trakt, OnDisk: true, File: file, WatchedAt: watchedAt}); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+func TestWatchedMediaOutsideHistoryWindowIsCleaned(t *testing.T) {
+	dir := t.TempDir()
+	app := newTestApp(t, Config{MoviesDir: dir, HistoryWindow: 24 * time.Hour})
+	// Seen in the history a month ago and kept, it is no longer in the window
+	files := seedWatched(t, app, dir, time.Now().Add(-30*24*time.Hour), 10)
+	if err := app.Store.Insert(int64(9), Media{Trakt: 9, OnDisk: true, File: filepath.Join(dir, "unwatched.mkv")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.markWatched(nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	cleaned, err := app.removeWatched()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleaned != 1 {
+		t.Errorf("cleaned %d medias, want 1", cleaned)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("watched file still on disk: %v", err)
+	}
+	if err := app.Store.Get(int64(9), &Media{}); err != nil {
+		t.Errorf("unwatched media removed: %v", err)
+	}
+}
+
+func TestMarkWatchedKeepsTheFirstTime(t *testing.T) {
+	app := newTestApp(t, Config{})
+	first := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range []time.Time{first, time.Now()} {
+		if err := app.markWatched([]int64{1, 2}, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var media Media
+	if err := app.Store.Get(int64(1), &media); err != nil {
+		t.Fatal(err)
+	}
+	if !media.WatchedAt.Equal(first) {
+		t.Errorf("watched at %v, want %v", media.WatchedAt, first)
+	}
+}
+
+func TestRemoveUntilFreeSpaceRemovesBiggestFirst(t *testing.T) {
+	dir := t.TempDir()
+	app := newTestApp(t, Config{MoviesDir: dir, CleanupFreeSpaceTarget: 250})
+	files := seedWatched(t, app, dir, time.Now(), 100, 300, 200)
+	sizes := map[string]int64{files[0]: 100, files[1]: 300, files[2]: 200}
+	// The disk is full but for the files removed
+	free := diskFreeSpace
+	defer func() { diskFreeSpace = free }()
+	diskFreeSpace = func(string) (int64, error) {
+		var freed int64
+		for file, size := range sizes {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				freed += size
+			}
+		}
+		return freed, nil
+	}
+
+	removed, err := app.removeUntilFreeSpace([]int64{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d medias, want 1", removed)
+	}
+	for i, want := range []bool{true, false, true} {
+		_, err := os.Stat(files[i])
+		if kept := err == nil; kept != want {
+			t.Errorf("%d bytes file kept = %v, want %v", sizes[files[i]], kept, want)
+		}
+	}
+}
+
+func TestCleanupModeArchivesRecords(t *testing.T) {
+	tests := []struct {
+		mode     string
+		archived int
+	}{
+		{"delete", 0},
+		{"archive", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			app := newTestApp(t, Config{MoviesDir: dir, CleanupMode: test.mode})
+			files := seedWatched(t, app, dir, time.Now(), 10)
+
+			if err := app.removeWatchedMedia(1); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.Store.Get(int64(1), &Media{}); err == nil {
+				t.Error("watched media still tracked")
+			}
+			if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+				t.Errorf("watched file still on disk: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			listArchive(w, httptest.NewRequest(http.MethodGet, "/api/archive", nil), app)
+			var archived []ArchivedMedia
+			if err := json.NewDecoder(w.Body).Decode(&archived); err != nil {
+				t.Fatal(err)
+			}
+			if len(archived) != test.archived {
+				t.Fatalf("%d archived medias, want %d", len(archived), test.archived)
+			}
+			if test.archived > 0 && (archived[0].Trakt != 1 || archived[0].ArchivedAt.IsZero()) {
+				t.Errorf("archived %+v, want media 1 with its archive time", archived[0])
+			}
+		})
+	}
+}
+
+// historyPages serves a Trakt watch history of a movie per page, movie n on page n.
+func historyPages(pages int, startAt *time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		*startAt, _ = time.Parse(time.RFC3339, r.URL.Query().Get("start_at"))
+		w.Header().Set("X-Pagination-Page", strconv.Itoa(page))
+		w.Header().Set("X-Pagination-Page-Count", strconv.Itoa(pages))
+		replyJSON([]map[string]interface{}{
+			{"id": page, "type": "movie", "action": "watch", "watched_at": time.Now().Format(time.RFC3339), "movie": map[string]interface{}{"title": "Movie", "year": 2020, "ids": map[string]int{"trakt": page}}},
+		})(w, r)
+	}
+}
+
+func TestHistoryWindowAndMaxItems(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   time.Duration
+		maxItems int
+		cleaned  int
+	}{
+		{"whole history", 24 * time.Hour, 0, 3},
+		{"capped history", 5 * 24 * time.Hour, 2, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var startAt time.Time
+			fakeTrakt(t, newFakeAPI(map[string]http.HandlerFunc{"/sync/history": historyPages(3, &startAt)}))
+			dir := t.TempDir()
+			app := newTestApp(t, Config{MoviesDir: dir, HistoryWindow: test.window, HistoryMaxItems: test.maxItems})
+			seedWatched(t, app, dir, time.Time{}, 1, 1, 1)
+
+			cleaned, err := app.cleanWatched()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cleaned != test.cleaned {
+				t.Errorf("cleaned %d medias, want %d", cleaned, test.cleaned)
+			}
+			if ago := time.Since(startAt); ago < test.window-time.Minute || ago > test.window+time.Minute {
+				t.Errorf("history read from %v ago, want %v", ago.Round(time.Minute), test.window)
+			}
+		})
+	}
+}
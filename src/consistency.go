@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+)
+
+type Inconsistency struct {
+	Media  Media    `json:"media"`
+	Issues []string `json:"issues"`
+}
+
+// mediaIssues lists what's wrong with a media row, nil when it can be searched and
+// downloaded as is.
+func mediaIssues(media Media) []string {
+	var issues []string
+	if media.Trakt == 0 {
+		issues = append(issues, "missing Trakt ID")
+	}
+	if media.IMDB == "" && media.TMDB == 0 && media.TVDB == 0 {
+		issues = append(issues, "missing IMDB, TMDB and TVDB ID")
+	}
+	if media.Number > 0 && media.Season == 0 {
+		issues = append(issues, "episode without season")
+	}
+	return issues
+}
+
+func inconsistentMedia() *bolthold.Query {
+	return bolthold.Where("IMDB").MatchFunc(func(ra *bolthold.RecordAccess) (bool, error) {
+		media, ok := ra.Record().(*Media)
+		if !ok {
+			return false, fmt.Errorf("record isn't the correct type! Wanted Media, got %T", ra.Record())
+		}
+		return len(mediaIssues(*media)) > 0, nil
+	})
+}
+
+func (app App) checkConsistency() ([]Inconsistency, error) {
+	var medias []Media
+	if err := app.Store.Find(&medias, inconsistentMedia()); err != nil {
+		return nil, fmt.Errorf("finding inconsistent media in database: %v", err)
+	}
+	inconsistencies := make([]Inconsistency, 0, len(medias))
+	for _, media := range medias {
+		inconsistencies = append(inconsistencies, Inconsistency{Media: media, Issues: mediaIssues(media)})
+	}
+	return inconsistencies, nil
+}
+
+// removeInconsistentMedia deletes the rows reported by checkConsistency along with
+// their NZBs. They come back from Trakt on the next sync if they're still wanted.
+func (app App) removeInconsistentMedia() ([]Inconsistency, error) {
+	inconsistencies, err := app.checkConsistency()
+	if err != nil {
+		return nil, err
+	}
+	if err := app.Store.DeleteMatching(&Media{}, inconsistentMedia()); err != nil {
+		return nil, fmt.Errorf("deleting inconsistent media from database: %v", err)
+	}
+	for _, inconsistency := range inconsistencies {
+		if inconsistency.Media.Trakt == 0 {
+			continue
+		}
+		if err := app.Store.DeleteMatching(&NZB{}, bolthold.Where("Trakt").Eq(inconsistency.Media.Trakt)); err != nil {
+			return nil, fmt.Errorf("deleting NZBs of inconsistent media from database: %v", err)
+		}
+	}
+	return inconsistencies, nil
+}
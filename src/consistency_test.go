@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/amaumene/momenarr/bolthold"
+	"testing"
+)
+
+func TestConsistencyFlagsBadRows(t *testing.T) {
+	app := newTestApp(t, Config{})
+	rows := []Media{
+		{Trakt: 1, IMDB: "tt1"},
+		{Trakt: 2},
+		{Trakt: 3, Show: 30, TVDB: 300, Number: 4},
+		{Trakt: 0, IMDB: "tt4"},
+		{Trakt: 5, Show: 50, TVDB: 500, Season: 1, Number: 1},
+	}
+	for _, media := range rows {
+		if err := app.Store.Insert(media.Trakt, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Store.Insert("nzb2", NZB{GUID: "nzb2", Trakt: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	inconsistencies, err := app.checkConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]string{
+		0: "missing Trakt ID",
+		2: "missing IMDB, TMDB and TVDB ID",
+		3: "episode without season",
+	}
+	if len(inconsistencies) != len(want) {
+		t.Fatalf("got %d inconsistencies, want %d: %+v", len(inconsistencies), len(want), inconsistencies)
+	}
+	for _, inconsistency := range inconsistencies {
+		issue, ok := want[inconsistency.Media.Trakt]
+		if !ok || len(inconsistency.Issues) != 1 || inconsistency.Issues[0] != issue {
+			t.Errorf("media %d flagged with %v, want %q", inconsistency.Media.Trakt, inconsistency.Issues, issue)
+		}
+	}
+
+	if _, err := app.removeInconsistentMedia(); err != nil {
+		t.Fatal(err)
+	}
+	count, err := app.Store.Count(&Media{}, &bolthold.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d media left after removal, want the 2 consistent ones", count)
+	}
+	nzbs, err := app.Store.Count(&NZB{}, bolthold.Where("Trakt").Eq(int64(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nzbs != 0 {
+		t.Errorf("%d NZBs of a removed media left", nzbs)
+	}
+}
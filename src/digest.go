@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func mediaLabel(media Media) string {
+	if media.IsMovie() {
+		return fmt.Sprintf("%s (%d)", media.Title, media.Year)
+	}
+	return fmt.Sprintf("%s S%02dE%02d", media.Title, media.Season, media.Number)
+}
+
+// buildDigest summarizes the files downloaded and the NZBs failed since the given time,
+// and the medias still missing.
+func (app App) buildDigest(since time.Time) (string, error) {
+	var onDisk []Media
+	if err := app.Store.Find(&onDisk, bolthold.Where("OnDisk").Eq(true).SortBy("Title")); err != nil {
+		return "", fmt.Errorf("finding media on disk: %v", err)
+	}
+	missing, err := findMediasNotOnDisk(app.Store)
+	if err != nil {
+		return "", err
+	}
+	failed, err := app.findFailedNZBs()
+	if err != nil {
+		return "", err
+	}
+
+	var body strings.Builder
+	body.WriteString("Downloaded:\n")
+	for _, media := range onDisk {
+		if media.DownloadedAt.After(since) {
+			fmt.Fprintf(&body, "  %s\n", mediaLabel(media))
+		}
+	}
+	body.WriteString("\nFailed:\n")
+	for _, nzb := range failed {
+		if nzb.FailedAt.After(since) {
+			fmt.Fprintf(&body, "  %s\n", nzb.Title)
+		}
+	}
+	body.WriteString("\nMissing:\n")
+	for _, media := range missing {
+		status := "no release found yet"
+		if media.DownloadID != "" {
+			status = "downloading"
+		}
+		fmt.Fprintf(&body, "  %s: %s\n", mediaLabel(media), status)
+	}
+	return body.String(), nil
+}
+
+func (config Config) sendMail(subject string, body string) error {
+	address := net.JoinHostPort(config.SMTPHost, strconv.Itoa(config.SMTPPort))
+	var auth smtp.Auth
+	if config.SMTPUser != "" {
+		auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPass, config.SMTPHost)
+	}
+	message := "From: " + config.SMTPFrom + "\r\n" +
+		"To: " + strings.Join(config.SMTPTo, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(address, auth, config.SMTPFrom, config.SMTPTo, []byte(message))
+}
+
+// startDigest mails a digest every DIGEST_INTERVAL. It does nothing until SMTP_HOST and
+// SMTP_TO are set.
+func startDigest(appConfig *App) {
+	since := time.Now()
+	for {
+		config := appConfig.Config()
+		if config.SMTPHost == "" || len(config.SMTPTo) == 0 || config.DigestInterval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(config.DigestInterval)
+		now := time.Now()
+		if !appConfig.Tasks.Start() {
+			return
+		}
+		body, err := appConfig.buildDigest(since)
+		appConfig.Tasks.Done()
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("building digest")
+			continue
+		}
+		if err := appConfig.Config().sendMail("momenarr digest", body); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("sending digest")
+			continue
+		}
+		since = now
+	}
+}
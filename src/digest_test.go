@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts one message on a local port and sends its data on the returned channel.
+func fakeSMTP(t *testing.T) (string, int, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+		reply("220 localhost")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					messages <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "DATA"):
+				inData = true
+				reply("354 Go ahead")
+			case strings.HasPrefix(command, "QUIT"):
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	address := listener.Addr().(*net.TCPAddr)
+	return "127.0.0.1", address.Port, messages
+}
+
+func TestDigestIsMailed(t *testing.T) {
+	host, port, messages := fakeSMTP(t)
+	app := newTestApp(t, Config{SMTPHost: host, SMTPPort: port, SMTPFrom: "momenarr@example.com", SMTPTo: []string{"me@example.com"}})
+	since := time.Now().Add(-time.Hour)
+	for key, record := range map[interface{}]interface{}{
+		int64(1):   Media{Trakt: 1, Title: "New Movie", Year: 2024, OnDisk: true, DownloadedAt: time.Now()},
+		int64(2):   Media{Trakt: 2, Title: "Old Movie", Year: 2020, OnDisk: true, DownloadedAt: since.Add(-time.Hour)},
+		int64(3):   Media{Trakt: 3, Title: "Show", Season: 1, Number: 2, DownloadID: "nzo3"},
+		"recent":   NZB{GUID: "recent", Trakt: 3, Title: "Show.S01E02.Recent", Failed: true, FailedAt: time.Now()},
+		"previous": NZB{GUID: "previous", Trakt: 3, Title: "Show.S01E02.Previous", Failed: true, FailedAt: since.Add(-time.Hour)},
+	} {
+		if err := app.Store.Insert(key, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, err := app.buildDigest(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Config().sendMail("momenarr digest", body); err != nil {
+		t.Fatalf("sending digest: %v", err)
+	}
+	var message string
+	select {
+	case message = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	for _, want := range []string{"Subject: momenarr digest", "To: me@example.com", "New Movie (2024)", "Show.S01E02.Recent", "Show S01E02: downloading"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("digest doesn't contain %q:\n%s", want, message)
+		}
+	}
+	for _, unwanted := range []string{"Old Movie", "Show.S01E02.Previous"} {
+		if strings.Contains(message, unwanted) {
+			t.Errorf("digest contains %q from before the last one:\n%s", unwanted, message)
+		}
+	}
+}
+
+func TestSendMailFailsWithoutServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	config := Config{SMTPHost: "127.0.0.1", SMTPPort: port, SMTPFrom: "momenarr@example.com", SMTPTo: []string{"me@example.com"}}
+	if err := config.sendMail("momenarr digest", "body"); err == nil {
+		t.Errorf("sending to port %d without a server succeeded", port)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A bare DC only counts as a director's cut next to the year or resolution, as in
+// Title.2019.DC.1080p, so titles starting with DC aren't mistaken for one.
+var editionPatterns = map[string]*regexp.Regexp{
+	"extended":      regexp.MustCompile(`(?i)\bextended\b`),
+	"directors-cut": regexp.MustCompile(`(?i)\bdirector'?s[ ._-]?cut\b|\b(?:19|20)\d\d[ ._-]dc\b|\bdc[ ._-]\d{3,4}p\b`),
+	"unrated":       regexp.MustCompile(`(?i)\bunrated\b`),
+	"theatrical":    regexp.MustCompile(`(?i)\btheatrical\b`),
+}
+
+// parseEdition returns the edition a release title is tagged with, or "" for none.
+func parseEdition(title string) string {
+	for _, edition := range []string{"directors-cut", "extended", "unrated", "theatrical"} {
+		if editionPatterns[edition].MatchString(title) {
+			return edition
+		}
+	}
+	return ""
+}
+
+func normalizeEdition(edition string) (string, error) {
+	edition = strings.ToLower(strings.TrimSpace(edition))
+	if _, ok := editionPatterns[edition]; !ok && edition != "" {
+		return "", fmt.Errorf("edition must be one of extended, directors-cut, unrated or theatrical")
+	}
+	return edition, nil
+}
+
+// editionFor returns the edition to prefer for a media: its own, else PREFERRED_EDITION
+// for movies.
+func (config Config) editionFor(media Media) string {
+	if media.Edition != "" {
+		return media.Edition
+	}
+	if media.IsMovie() {
+		return config.PreferredEdition
+	}
+	return ""
+}
+
+func (app App) setMediaEdition(Trakt int64, edition string) (Media, error) {
+	var media Media
+	if err := app.Store.Get(Trakt, &media); err != nil {
+		return media, fmt.Errorf("getting media from database: %w", err)
+	}
+	media.Edition = edition
+	if err := app.Store.Update(Trakt, media); err != nil {
+		return media, fmt.Errorf("updating media edition in database: %v", err)
+	}
+	return media, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestParseEdition(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Blade.Runner.1982.Directors.Cut.1080p.BluRay.x264", "directors-cut"},
+		{"Blade Runner 1982 Director's Cut 2160p", "directors-cut"},
+		{"Watchmen.2009.DC.1080p.BluRay.x264", "directors-cut"},
+		{"Watchmen.DC.1080p.BluRay.x264", "directors-cut"},
+		{"DC.League.of.Super-Pets.2022.1080p.WEB-DL", ""},
+		{"Aliens.1986.Extended.1080p.BluRay", "extended"},
+		{"Movie.2010.UNRATED.720p", "unrated"},
+		{"Movie.2010.Theatrical.Cut.1080p", "theatrical"},
+		{"Movie.2010.1080p.WEB-DL", ""},
+	}
+	for _, test := range tests {
+		if got := parseEdition(test.title); got != test.want {
+			t.Errorf("parseEdition(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
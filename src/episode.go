@@ -1,18 +1,225 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
 	"github.com/amaumene/momenarr/trakt"
 	"github.com/amaumene/momenarr/trakt/episode"
 	"github.com/amaumene/momenarr/trakt/show"
 	"github.com/amaumene/momenarr/trakt/sync"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
 )
 
+const progressRetries = 3
+
+// progressRetryDelay is how long the first retry of a Trakt call waits, the next ones
+// wait longer.
+var progressRetryDelay = time.Second
+
+func (app App) trackShowProgress(s *trakt.Show, next *trakt.Episode) error {
+	progress := ShowProgress{Show: int64(s.Trakt)}
+	err := app.Store.Get(progress.Show, &progress)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("getting show progress from database: %v", err)
+	}
+	if err == nil && (next.Season < progress.Season || next.Season == progress.Season && next.Number < progress.Number) {
+		log.WithFields(log.Fields{
+			"show":     s.Title,
+			"previous": fmt.Sprintf("S%02dE%02d", progress.Season, progress.Number),
+			"next":     fmt.Sprintf("S%02dE%02d", next.Season, next.Number),
+		}).Info("Show progress was reset, re-queuing episodes")
+		progress.ResetAt = time.Now()
+		if err := app.requeueEpisodes(s, next, progress); err != nil {
+			return err
+		}
+	}
+	progress.Season = next.Season
+	progress.Number = next.Number
+	if err := app.Store.Upsert(progress.Show, progress); err != nil {
+		return fmt.Errorf("saving show progress to database: %v", err)
+	}
+	return nil
+}
+
+// episodeBefore reports whether episode number of season comes before otherNumber of otherSeason.
+func episodeBefore(season, number, otherSeason, otherNumber int64) bool {
+	return season < otherSeason || season == otherSeason && number < otherNumber
+}
+
+// requeueEpisodes makes the episodes of s from next up to the previous progress wanted
+// again: next is added, the archived ones are restored and the ones whose file is gone
+// are downloaded again.
+func (app App) requeueEpisodes(s *trakt.Show, next *trakt.Episode, previous ShowProgress) error {
+	if err := app.insertEpisodeToDB(s, next); err != nil {
+		return err
+	}
+	rewatched := func(media Media) bool {
+		return !episodeBefore(media.Season, media.Number, next.Season, next.Number) &&
+			episodeBefore(media.Season, media.Number, previous.Season, previous.Number)
+	}
+	var requeued []int64
+
+	var medias []Media
+	if err := app.Store.Find(&medias, bolthold.Where("Show").Eq(int64(s.Trakt))); err != nil {
+		return fmt.Errorf("finding episodes of show: %v", err)
+	}
+	for _, media := range medias {
+		if !rewatched(media) {
+			continue
+		}
+		// Not watched anymore, so the cleanup keeps it until it is watched again
+		media.WatchedAt = time.Time{}
+		missing := false
+		if media.OnDisk {
+			_, err := os.Stat(media.File)
+			missing = os.IsNotExist(err)
+		}
+		if missing {
+			media.OnDisk = false
+			media.File = ""
+			media.DownloadID = ""
+			media.DownloadStatus = ""
+			requeued = append(requeued, media.Trakt)
+		}
+		if err := app.Store.Update(media.Trakt, media); err != nil {
+			return fmt.Errorf("updating media status in database: %v", err)
+		}
+	}
+
+	var archived []ArchivedMedia
+	if err := app.Store.Find(&archived, bolthold.Where("Show").Eq(int64(s.Trakt))); err != nil {
+		return fmt.Errorf("finding archived episodes of show: %v", err)
+	}
+	for _, entry := range archived {
+		media := entry.Media
+		if !rewatched(media) {
+			continue
+		}
+		media.OnDisk = false
+		media.File = ""
+		media.DownloadID = ""
+		media.DownloadStatus = ""
+		media.LastSearchAt = time.Time{}
+		media.EmptySearches = 0
+		media.WatchedAt = time.Time{}
+		err := app.Store.Insert(media.Trakt, media)
+		if errors.Is(err, ErrDuplicateKey) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("restoring archived episode: %v", err)
+		}
+		app.emit(EventMediaAdded, media, "")
+		requeued = append(requeued, media.Trakt)
+	}
+
+	if len(requeued) > 0 {
+		log.WithFields(log.Fields{
+			"show":     s.Title,
+			"episodes": len(requeued),
+		}).Info("Re-queued episodes to rewatch")
+		app.searchOnAdd(requeued...)
+	}
+	return nil
+}
+
+// retryDelay waits before the next attempt of a call, unless attempt was the last one.
+func retryDelay(attempt int) {
+	if attempt < progressRetries-1 {
+		time.Sleep(time.Duration(attempt+1) * progressRetryDelay)
+	}
+}
+
+// trackedEpisodes returns the IDs of the episodes of show already in the database.
+func (app App) trackedEpisodes(show int64) ([]interface{}, error) {
+	var medias []Media
+	if err := app.Store.Find(&medias, bolthold.Where("Show").Eq(show)); err != nil {
+		return nil, fmt.Errorf("finding tracked episodes: %v", err)
+	}
+	var ids []interface{}
+	for _, media := range medias {
+		ids = append(ids, media.Trakt)
+	}
+	return ids, nil
+}
+
+// getNextEpisode returns the next episode to watch of the show. When its progress can't be
+// read, it returns the episodes already tracked instead so the sync keeps them, or the first
+// episode of the show when none are tracked yet.
+func (app App) getNextEpisode(s *trakt.Show) (*trakt.Episode, []interface{}, error) {
+	progressParams := &trakt.ProgressParams{
+		Params: trakt.Params{OAuth: app.TraktToken.AccessToken},
+	}
+	var err error
+	for i := 0; i < progressRetries; i++ {
+		var showProgress *trakt.WatchedProgress
+		err = app.timeCall("trakt.WatchedProgress", func() error {
+			var err error
+			showProgress, err = show.WatchedProgress(s.Trakt, progressParams)
+			return err
+		})
+		if err == nil {
+			if showProgress.NextEpisode != nil {
+				if err := app.trackShowProgress(s, showProgress.NextEpisode); err != nil {
+					log.WithFields(log.Fields{
+						"err":  err,
+						"show": s.Title,
+					}).Error("tracking show progress")
+				}
+			}
+			return showProgress.NextEpisode, nil, nil
+		}
+		retryDelay(i)
+	}
+	tracked, trackedErr := app.trackedEpisodes(int64(s.Trakt))
+	if trackedErr != nil {
+		return nil, nil, fmt.Errorf("getting progress of %s: %v, %v", s.Title, err, trackedErr)
+	}
+	if len(tracked) > 0 {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"show": s.Title,
+		}).Warning("getting show progress failed, keeping tracked episodes")
+		return nil, tracked, nil
+	}
+	log.WithFields(log.Fields{
+		"err":  err,
+		"show": s.Title,
+	}).Warning("getting show progress failed, falling back to first episode")
+
+	for i := 0; i < progressRetries; i++ {
+		var firstEpisode *trakt.Episode
+		err = app.timeCall("trakt.EpisodeGet", func() error {
+			var err error
+			firstEpisode, err = episode.Get(s.Trakt, 1, 1, nil)
+			return err
+		})
+		if err == nil {
+			return firstEpisode, nil, nil
+		}
+		retryDelay(i)
+	}
+	return nil, nil, fmt.Errorf("getting first episode of %s: %v", s.Title, err)
+}
+
+// maxEpisodesFor returns how many upcoming episodes of show are tracked at once.
+func (config Config) maxEpisodesFor(show int64) int {
+	if max, ok := config.MaxEpisodesPerShowOverrides[show]; ok {
+		return int(max)
+	}
+	return config.MaxEpisodesPerShow
+}
+
 func (app App) insertEpisodeToDB(show *trakt.Show, ep *trakt.Episode) error {
-	if int64(ep.Trakt) > 0 && len(show.IMDB) > 0 && ep.Number > 0 && ep.Season > 0 {
+	hasID := len(show.IMDB) > 0 || (app.Config().AllowMissingIMDB && show.TVDB > 0)
+	if int64(ep.Trakt) > 0 && hasID && ep.Number > 0 && ep.Season > 0 {
 		media := Media{
 			Trakt:  int64(ep.Trakt),
+			Show:   int64(show.Trakt),
+			TVDB:   int64(show.TVDB),
 			Number: ep.Number,
 			Season: ep.Season,
 			IMDB:   string(show.IMDB),
@@ -20,50 +227,73 @@ func (app App) insertEpisodeToDB(show *trakt.Show, ep *trakt.Episode) error {
 			Year:   show.Year,
 		}
 		err := app.Store.Insert(int64(ep.Trakt), media)
-		if err != nil && err.Error() != "This Key already exists in this bolthold for this type" {
+		if err != nil && !errors.Is(err, ErrDuplicateKey) {
 			return fmt.Errorf("inserting episode into database: %v", err)
 		}
+		if err == nil {
+			app.emit(EventMediaAdded, media, "")
+			app.searchOnAdd(media.Trakt)
+		}
 	}
 	return nil
 }
 
-func (app App) syncEpisodesFromFavorites() (error, []interface{}) {
+func (app App) syncEpisodesFromFavorites(seen map[int64]bool) (error, []interface{}) {
 	tokenParams := trakt.ListParams{OAuth: app.TraktToken.AccessToken}
 	params := &trakt.ListFavoritesParams{
 		ListParams: tokenParams,
-		Type:       "shows",
+		Type:       trakt.TypeShow,
 	}
 	iterator := sync.Favorites(params)
 
 	var episodes []interface{}
-	for iterator.Next() {
+	failed := 0
+	for app.timedNext("trakt.Favorites", iterator) {
 		item, err := iterator.Entry()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("scanning episode item")
+			continue
 		}
-		progressParams := &trakt.ProgressParams{
-			Params: trakt.Params{OAuth: app.TraktToken.AccessToken},
+		if seen[int64(item.Show.Trakt)] {
+			continue
 		}
-		showProgress, err := show.WatchedProgress(item.Show.Trakt, progressParams)
+		seen[int64(item.Show.Trakt)] = true
+		app.detectShowRemap(item.Show)
+		next, tracked, err := app.getNextEpisode(item.Show)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("getting show progress")
+			failed++
+			continue
 		}
-		if showProgress.NextEpisode != nil {
-			for i := 0; i < 3; i++ {
-				nextEpisode, err := episode.Get(item.Show.Trakt, showProgress.NextEpisode.Season, showProgress.NextEpisode.Number+int64(i), nil)
+		episodes = append(episodes, tracked...)
+		if next != nil {
+			season, number := next.Season, next.Number
+			for i := 0; i < app.Config().maxEpisodesFor(int64(item.Show.Trakt)); i++ {
+				var nextEpisode *trakt.Episode
+				err := app.timeCall("trakt.EpisodeGet", func() error {
+					var err error
+					nextEpisode, err = episode.Get(item.Show.Trakt, season, number, nil)
+					return err
+				})
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
 					}).Error("getting next episode from trakt")
-					nextEpisode, err = episode.Get(item.Show.Trakt, showProgress.NextEpisode.Season+int64(1), 1, nil)
+					// Past the end of the season, carry on from the first episode of the next one
+					err = app.timeCall("trakt.EpisodeGet", func() error {
+						var err error
+						nextEpisode, err = episode.Get(item.Show.Trakt, season+1, 1, nil)
+						return err
+					})
 					if err != nil {
 						log.WithFields(log.Fields{
 							"err": err,
 						}).Error("probably no more episodes")
+						break
 					}
 				}
 				if err := app.insertEpisodeToDB(item.Show, nextEpisode); err != nil {
@@ -72,62 +302,88 @@ func (app App) syncEpisodesFromFavorites() (error, []interface{}) {
 					}).Error("inserting episode into database")
 				}
 				episodes = append(episodes, int64(nextEpisode.Trakt))
+				season, number = nextEpisode.Season, nextEpisode.Number+1
 			}
 		}
 	}
 	if err := iterator.Err(); err != nil {
 		return fmt.Errorf("iterating episode watchlist: %v", err), nil
 	}
+	// The episodes of a show that failed aren't in the list, so it must not be used to prune
+	if failed > 0 {
+		return fmt.Errorf("syncing %d shows failed", failed), nil
+	}
 	return nil, episodes
 }
 
-func (app App) syncEpisodesFromWatchlist() (error, []interface{}) {
+func (app App) syncEpisodesFromWatchlist(seen map[int64]bool) (error, []interface{}) {
 	tokenParams := trakt.ListParams{OAuth: app.TraktToken.AccessToken}
 	watchListParams := &trakt.ListWatchListParams{
 		ListParams: tokenParams,
-		Type:       "show",
+		Type:       trakt.TypeShow,
 	}
 	iterator := sync.WatchList(watchListParams)
 
 	var episodes []interface{}
-	for iterator.Next() {
+	failed := 0
+	for app.timedNext("trakt.WatchList", iterator) {
 		item, err := iterator.Entry()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("scanning episode item")
+			continue
 		}
-		progressParams := &trakt.ProgressParams{
-			Params: trakt.Params{OAuth: app.TraktToken.AccessToken},
+		if seen[int64(item.Show.Trakt)] {
+			continue
 		}
-		showProgress, err := show.WatchedProgress(item.Show.Trakt, progressParams)
+		seen[int64(item.Show.Trakt)] = true
+		app.detectShowRemap(item.Show)
+		nextEpisode, tracked, err := app.getNextEpisode(item.Show)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("getting show progress")
+			failed++
+			continue
+		}
+		episodes = append(episodes, tracked...)
+		if nextEpisode == nil {
+			continue
 		}
-		if err := app.insertEpisodeToDB(item.Show, showProgress.NextEpisode); err != nil {
+		if err := app.insertEpisodeToDB(item.Show, nextEpisode); err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("inserting episode into database")
 		}
-		episodes = append(episodes, int64(item.Show.Trakt))
+		episodes = append(episodes, int64(nextEpisode.Trakt))
 	}
 	if err := iterator.Err(); err != nil {
 		return fmt.Errorf("iterating episode watchlist: %v", err), nil
 	}
+	// The episodes of a show that failed aren't in the list, so it must not be used to prune
+	if failed > 0 {
+		return fmt.Errorf("syncing %d shows failed", failed), nil
+	}
 	return nil, episodes
 }
 
 func (app App) syncEpisodesFromTrakt() (error, []interface{}) {
-	err, watchlist := app.syncEpisodesFromWatchlist()
-	if err != nil {
-		return err, nil
+	// A show in both lists is only synced by the first one. Favorites track more episodes than the watchlist,
+	// so they go first unless EPISODE_SOURCE_PRECEDENCE says otherwise
+	seen := make(map[int64]bool)
+	app.remapShowIDs()
+	sources := []func(map[int64]bool) (error, []interface{}){app.syncEpisodesFromFavorites, app.syncEpisodesFromWatchlist}
+	if app.Config().EpisodeSourcePrecedence == "watchlist" {
+		sources[0], sources[1] = sources[1], sources[0]
 	}
-	err, favorites := app.syncEpisodesFromFavorites()
-	if err != nil {
-		return err, nil
+	var mergedEpisodes []interface{}
+	for _, source := range sources {
+		err, episodes := source(seen)
+		if err != nil {
+			return err, nil
+		}
+		mergedEpisodes = append(mergedEpisodes, episodes...)
 	}
-	mergedEpisodes := append(watchlist, favorites...)
 	return nil, mergedEpisodes
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"github.com/amaumene/momenarr/trakt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProgressResetRequeuesEpisodes(t *testing.T) {
+	app := newTestApp(t, Config{})
+	show := &trakt.Show{}
+	show.Trakt = 10
+	show.IMDB = "tt10"
+	show.Title = "Show"
+
+	missing := filepath.Join(t.TempDir(), "missing.mkv")
+	for key, record := range map[interface{}]interface{}{
+		int64(10):  ShowProgress{Show: 10, Season: 2, Number: 3},
+		int64(102): ArchivedMedia{Media: Media{Trakt: 102, Show: 10, Season: 1, Number: 2, OnDisk: true, File: missing}},
+		int64(201): ArchivedMedia{Media: Media{Trakt: 201, Show: 10, Season: 2, Number: 1, OnDisk: true, File: missing}},
+		int64(103): Media{Trakt: 103, Show: 10, Season: 1, Number: 3, OnDisk: true, File: missing, WatchedAt: time.Now()},
+		int64(203): Media{Trakt: 203, Show: 10, Season: 2, Number: 3, OnDisk: true, File: missing},
+	} {
+		if err := app.Store.Insert(key, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := &trakt.Episode{Season: 1, Number: 1}
+	next.Trakt = 101
+	if err := app.trackShowProgress(show, next); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, Trakt := range []int64{101, 102, 103, 201} {
+		var media Media
+		if err := app.Store.Get(Trakt, &media); err != nil {
+			t.Errorf("episode %d not re-queued: %v", Trakt, err)
+			continue
+		}
+		if media.OnDisk || media.File != "" || !media.WatchedAt.IsZero() {
+			t.Errorf("episode %d = on disk %v, file %q, watched at %v, want it wanted", Trakt, media.OnDisk, media.File, media.WatchedAt)
+		}
+	}
+	// S02E03 was the next episode before the reset, it isn't rewatched yet
+	var current Media
+	if err := app.Store.Get(int64(203), &current); err != nil {
+		t.Fatal(err)
+	}
+	if !current.OnDisk {
+		t.Error("episode past the previous progress re-queued")
+	}
+
+	var progress ShowProgress
+	if err := app.Store.Get(int64(10), &progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Season != 1 || progress.Number != 1 || progress.ResetAt.IsZero() {
+		t.Errorf("progress = S%02dE%02d reset at %v, want S01E01 with a reset time", progress.Season, progress.Number, progress.ResetAt)
+	}
+}
+
+func TestProgressMovingForwardRequeuesNothing(t *testing.T) {
+	app := newTestApp(t, Config{})
+	show := &trakt.Show{}
+	show.Trakt = 10
+	show.IMDB = "tt10"
+	if err := app.Store.Insert(int64(10), ShowProgress{Show: 10, Season: 1, Number: 1}); err != nil {
+		t.Fatal(err)
+	}
+	next := &trakt.Episode{Season: 1, Number: 2}
+	next.Trakt = 102
+	if err := app.trackShowProgress(show, next); err != nil {
+		t.Fatal(err)
+	}
+	var progress ShowProgress
+	if err := app.Store.Get(int64(10), &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !progress.ResetAt.IsZero() {
+		t.Error("moving forward was taken for a reset")
+	}
+	if err := app.Store.Get(int64(102), &Media{}); err == nil {
+		t.Error("moving forward inserted the next episode outside of the sync")
+	}
+}
+
+// fastRetries makes the Trakt retries wait a millisecond until the test ends.
+func fastRetries(t *testing.T) {
+	delay := progressRetryDelay
+	progressRetryDelay = time.Millisecond
+	t.Cleanup(func() { progressRetryDelay = delay })
+}
+
+func TestProgressFailureFallsBackToFirstEpisode(t *testing.T) {
+	fastRetries(t)
+	api := newFakeAPI(map[string]http.HandlerFunc{
+		"/shows/10/progress/watched":     replyStatus(http.StatusInternalServerError),
+		"/shows/10/seasons/1/episodes/1": replyJSON(map[string]interface{}{"season": 1, "number": 1, "title": "Pilot", "ids": map[string]int{"trakt": 101}}),
+		"/shows/20/progress/watched":     replyStatus(http.StatusInternalServerError),
+		"/shows/20/seasons/1/episodes/1": replyStatus(http.StatusInternalServerError),
+	})
+	fakeTrakt(t, api)
+	app := newTestApp(t, Config{})
+	show := &trakt.Show{}
+	show.Trakt = 10
+	show.IMDB = "tt10"
+
+	next, tracked, err := app.getNextEpisode(show)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || next.Season != 1 || next.Number != 1 || next.Trakt != 101 || tracked != nil {
+		t.Fatalf("next episode = %+v, tracked %v, want S01E01", next, tracked)
+	}
+	if got := api.Calls("/shows/10/progress/watched"); got != progressRetries {
+		t.Errorf("progress fetched %d times, want %d", got, progressRetries)
+	}
+	if err := app.insertEpisodeToDB(show, next); err != nil {
+		t.Fatal(err)
+	}
+	var media Media
+	if err := app.Store.Get(int64(101), &media); err != nil || media.Show != 10 || media.Season != 1 || media.Number != 1 {
+		t.Errorf("inserted episode = %+v, %v, want S01E01 of show 10", media, err)
+	}
+
+	// Already tracked episodes are kept rather than replaced by the first one
+	show.Trakt = 20
+	if err := app.Store.Insert(int64(205), Media{Trakt: 205, Show: 20, Season: 2, Number: 5}); err != nil {
+		t.Fatal(err)
+	}
+	next, tracked, err = app.getNextEpisode(show)
+	if err != nil || next != nil || len(tracked) != 1 || tracked[0] != int64(205) {
+		t.Errorf("with tracked episodes = %+v, %v, %v, want the tracked episode kept", next, tracked, err)
+	}
+	if got := api.Calls("/shows/20/seasons/1/episodes/1"); got != 0 {
+		t.Errorf("first episode fetched %d times with episodes tracked", got)
+	}
+}
+
+// showEntry is a show in a Trakt favorites or watchlist page.
+func showEntry(Trakt int, imdb string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "show",
+		"show": map[string]interface{}{"title": imdb, "year": 2020, "ids": map[string]interface{}{"trakt": Trakt, "imdb": imdb}},
+	}
+}
+
+// episodeJSON is an episode as Trakt returns it.
+func episodeJSON(Trakt, season, number int) map[string]interface{} {
+	return map[string]interface{}{"season": season, "number": number, "ids": map[string]int{"trakt": Trakt}}
+}
+
+func TestShowInBothListsIsSyncedOnce(t *testing.T) {
+	api := newFakeAPI(map[string]http.HandlerFunc{
+		"/sync/favorites/shows":          replyJSON([]interface{}{showEntry(10, "tt10")}),
+		"/sync/watchlist/shows":          replyJSON([]interface{}{showEntry(10, "tt10"), showEntry(20, "tt20")}),
+		"/shows/10/progress/watched":     replyJSON(map[string]interface{}{"next_episode": episodeJSON(101, 1, 1)}),
+		"/shows/10/seasons/1/episodes/1": replyJSON(episodeJSON(101, 1, 1)),
+		"/shows/20/progress/watched":     replyJSON(map[string]interface{}{"next_episode": episodeJSON(201, 1, 1)}),
+	})
+	fakeTrakt(t, api)
+	app := newTestApp(t, Config{MaxEpisodesPerShow: 1})
+
+	err, episodes := app.syncEpisodesFromTrakt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/shows/10/progress/watched", "/shows/20/progress/watched"} {
+		if got := api.Calls(path); got != 1 {
+			t.Errorf("%s fetched %d times, want 1", path, got)
+		}
+	}
+	if want := []interface{}{int64(101), int64(201)}; !reflect.DeepEqual(episodes, want) {
+		t.Errorf("synced episodes = %v, want %v", episodes, want)
+	}
+}
+
+func TestEpisodeSourcePrecedence(t *testing.T) {
+	tests := []struct {
+		precedence string
+		want       []interface{}
+	}{
+		{"", []interface{}{int64(101), int64(102)}},
+		{"favorites", []interface{}{int64(101), int64(102)}},
+		{"watchlist", []interface{}{int64(101)}},
+	}
+	for _, test := range tests {
+		t.Run(test.precedence, func(t *testing.T) {
+			fakeTrakt(t, newFakeAPI(map[string]http.HandlerFunc{
+				"/sync/favorites/shows":          replyJSON([]interface{}{showEntry(10, "tt10")}),
+				"/sync/watchlist/shows":          replyJSON([]interface{}{showEntry(10, "tt10")}),
+				"/shows/10/progress/watched":     replyJSON(map[string]interface{}{"next_episode": episodeJSON(101, 1, 1)}),
+				"/shows/10/seasons/1/episodes/1": replyJSON(episodeJSON(101, 1, 1)),
+				"/shows/10/seasons/1/episodes/2": replyJSON(episodeJSON(102, 1, 2)),
+			}))
+			// Favorites track MAX_EPISODES_PER_SHOW episodes, the watchlist only the next one
+			app := newTestApp(t, Config{MaxEpisodesPerShow: 2, EpisodeSourcePrecedence: test.precedence})
+
+			err, episodes := app.syncEpisodesFromTrakt()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(episodes, test.want) {
+				t.Errorf("synced episodes = %v, want %v", episodes, test.want)
+			}
+		})
+	}
+}
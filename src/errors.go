@@ -0,0 +1,9 @@
+package main
+
+import "github.com/amaumene/momenarr/bolthold"
+
+// Errors returned by the store, wrapped with %w so callers can check them with errors.Is
+var (
+	ErrNotFound     = bolthold.ErrNotFound
+	ErrDuplicateKey = bolthold.ErrKeyExists
+)
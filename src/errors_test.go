@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"github.com/amaumene/momenarr/newsnab"
+	"github.com/amaumene/momenarr/trakt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreErrorsMatchSentinels(t *testing.T) {
+	app := newTestApp(t, Config{})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, IMDB: "tt1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, IMDB: "tt1"}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("inserting a media twice: %v, want ErrDuplicateKey", err)
+	}
+	if err := app.Store.Insert("nzb", NZB{GUID: "nzb", Trakt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Store.Insert("nzb", NZB{GUID: "nzb", Trakt: 1}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("inserting an NZB twice: %v, want ErrDuplicateKey", err)
+	}
+
+	missing := map[string]error{
+		"removeMedia":           app.removeMedia(404),
+		"createDownload":        app.createDownload(404, NZB{}),
+		"updateMediaDownloadID": updateMediaDownloadID(app.Store, 404, []string{"nzo"}, "nzb"),
+	}
+	_, missing["setMediaEdition"] = app.setMediaEdition(404, "extended")
+	_, missing["getNzbFromDB"] = app.getNzbFromDB(404)
+	for name, err := range missing {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s of a missing media: %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestSavePathsTolerateDuplicates(t *testing.T) {
+	dataDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, "blacklist.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, Config{DataDir: dataDir})
+
+	movie := &trakt.Movie{Year: 2020}
+	movie.Trakt = 1
+	movie.IMDB = "tt1"
+	movie.Title = "Movie"
+	show := &trakt.Show{}
+	show.Trakt = 10
+	show.IMDB = "tt10"
+	episode := &trakt.Episode{Season: 1, Number: 1}
+	episode.Trakt = 11
+	for i := 0; i < 2; i++ {
+		if err := app.insertMovieToDB(movie); err != nil {
+			t.Errorf("inserting a movie again: %v", err)
+		}
+		if err := app.insertEpisodeToDB(show, episode); err != nil {
+			t.Errorf("inserting an episode again: %v", err)
+		}
+	}
+
+	item := newsnab.Item{Title: "Movie.2020.1080p", GUID: newsnab.GUID{Value: "guid"}, Enclosure: newsnab.Enclosure{URL: "https://indexer/guid", Length: "1"}}
+	for i, want := range []int{1, 0} {
+		inserted, err := app.insertNZBItems(Media{Trakt: 1}, []newsnab.Item{item})
+		if err != nil {
+			t.Errorf("inserting an NZB again: %v", err)
+		}
+		if inserted != want {
+			t.Errorf("insert %d: %d NZBs inserted, want %d", i+1, inserted, want)
+		}
+	}
+}
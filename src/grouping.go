@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type ShowGroup struct {
+	Show     int64   `json:"show"`
+	IMDB     string  `json:"imdb"`
+	TVDB     int64   `json:"tvdb,omitempty"`
+	Year     int64   `json:"year"`
+	OnDisk   int     `json:"on_disk"`
+	Total    int     `json:"total"`
+	Episodes []Media `json:"episodes"`
+}
+
+type MediaGroups struct {
+	Movies []Media     `json:"movies"`
+	Shows  []ShowGroup `json:"shows"`
+}
+
+// groupMedia puts episodes under their show, in season and episode order, and keeps
+// movies apart. Shows are told apart by IMDB ID, or TVDB ID when they have none, as
+// episodes stored before the Trakt show ID was recorded don't have one.
+func groupMedia(medias []Media) MediaGroups {
+	groups := MediaGroups{Movies: []Media{}, Shows: []ShowGroup{}}
+	index := make(map[string]int)
+	for _, media := range medias {
+		if media.IsMovie() {
+			groups.Movies = append(groups.Movies, media)
+			continue
+		}
+		key := media.IMDB
+		if key == "" {
+			key = fmt.Sprintf("tvdb:%d", media.TVDB)
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups.Shows)
+			index[key] = i
+			groups.Shows = append(groups.Shows, ShowGroup{IMDB: media.IMDB, TVDB: media.TVDB, Year: media.Year})
+		}
+		group := &groups.Shows[i]
+		if media.Show != 0 {
+			group.Show = media.Show
+		}
+		group.Total++
+		if media.OnDisk {
+			group.OnDisk++
+		}
+		group.Episodes = append(group.Episodes, media)
+	}
+	for _, group := range groups.Shows {
+		episodes := group.Episodes
+		sort.Slice(episodes, func(i, j int) bool {
+			if episodes[i].Season != episodes[j].Season {
+				return episodes[i].Season < episodes[j].Season
+			}
+			return episodes[i].Number < episodes[j].Number
+		})
+	}
+	return groups
+}
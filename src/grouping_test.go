@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestGroupMedia(t *testing.T) {
+	medias := []Media{
+		{Trakt: 1, IMDB: "tt1", Title: "Movie"},
+		{Trakt: 10, Show: 100, IMDB: "tt100", Season: 1, Number: 2, OnDisk: true},
+		{Trakt: 20, TVDB: 200, Season: 2, Number: 1},
+		{Trakt: 11, Show: 100, IMDB: "tt100", Season: 1, Number: 1, OnDisk: true},
+		{Trakt: 12, IMDB: "tt100", Season: 2, Number: 1},
+		{Trakt: 21, TVDB: 200, Season: 1, Number: 5, OnDisk: true},
+	}
+	groups := groupMedia(medias)
+
+	if len(groups.Movies) != 1 || groups.Movies[0].Trakt != 1 {
+		t.Errorf("movies = %+v, want only the movie", groups.Movies)
+	}
+	want := []struct {
+		show     int64
+		onDisk   int
+		episodes []int64
+	}{
+		{100, 2, []int64{11, 10, 12}},
+		{0, 1, []int64{21, 20}},
+	}
+	if len(groups.Shows) != len(want) {
+		t.Fatalf("got %d shows, want %d", len(groups.Shows), len(want))
+	}
+	for i, group := range groups.Shows {
+		if group.Show != want[i].show || group.OnDisk != want[i].onDisk || group.Total != len(want[i].episodes) {
+			t.Errorf("show %d = show %d, %d/%d on disk, want show %d, %d/%d", i, group.Show, group.OnDisk, group.Total, want[i].show, want[i].onDisk, len(want[i].episodes))
+		}
+		var episodes []int64
+		for _, episode := range group.Episodes {
+			episodes = append(episodes, episode.Trakt)
+		}
+		if len(episodes) != len(want[i].episodes) {
+			t.Errorf("show %d episodes = %v, want %v", i, episodes, want[i].episodes)
+			continue
+		}
+		for j := range episodes {
+			if episodes[j] != want[i].episodes[j] {
+				t.Errorf("show %d episodes = %v, want %v", i, episodes, want[i].episodes)
+				break
+			}
+		}
+	}
+}
@@ -1,46 +1,123 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/amaumene/momenarr/bolthold"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func listMedia(w http.ResponseWriter, appConfig App) {
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	var medias []Media
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("writing response")
+	}
+}
+
+func listMedia(w http.ResponseWriter, r *http.Request, appConfig App) {
+	medias := []Media{}
 	q := &bolthold.Query{}
+	if tag := normalizeTag(r.URL.Query().Get("tag")); tag != "" {
+		q = bolthold.Where("Tags").Contains(tag)
+	}
+	switch r.URL.Query().Get("sort") {
+	case "":
+	case "downloaded":
+		q = q.SortBy("DownloadedAt").Reverse()
+	default:
+		http.Error(w, "sort must be downloaded", http.StatusBadRequest)
+		return
+	}
 	err := appConfig.Store.Find(&medias, q)
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("getting medias from database")
 	}
+	grouped := r.URL.Query().Get("group") == "show"
+	if wantsJSON(r) {
+		if grouped {
+			writeJSON(w, groupMedia(medias))
+			return
+		}
+		writeJSON(w, medias)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 	var data string
-	for _, media := range medias {
-		data = data + fmt.Sprintf("IMDB: %s\nTitle: %s\nOnDisk: %t\nFile:%s\n", media.IMDB, media.Title, media.OnDisk, media.File)
+	if grouped {
+		groups := groupMedia(medias)
+		data = "Movies:\n"
+		for _, media := range groups.Movies {
+			data = data + formatMedia(media)
+		}
+		for _, show := range groups.Shows {
+			data = data + fmt.Sprintf("\nShow %d (IMDB: %s): %d/%d on disk\n", show.Show, show.IMDB, show.OnDisk, show.Total)
+			for _, media := range show.Episodes {
+				data = data + fmt.Sprintf("S%02dE%02d ", media.Season, media.Number) + formatMedia(media)
+			}
+		}
+	} else {
+		for _, media := range medias {
+			data = data + formatMedia(media)
+		}
 	}
 	if _, err := w.Write([]byte(data)); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("writing response")
 	}
 }
-func listNZBs(w http.ResponseWriter, appConfig App) {
-	w.WriteHeader(http.StatusOK)
-	var nzbs []NZB
+func formatMedia(media Media) string {
+	data := fmt.Sprintf("IMDB: %s\nTitle: %s\nOnDisk: %t\nFile:%s\n", media.IMDB, media.Title, media.OnDisk, media.File)
+	if !media.DownloadedAt.IsZero() {
+		data = data + fmt.Sprintf("DownloadedAt: %s\n", media.DownloadedAt.Format(time.RFC3339))
+	}
+	return data
+}
+
+func listNZBs(w http.ResponseWriter, r *http.Request, appConfig App) {
+	nzbs := []NZB{}
 	q := &bolthold.Query{}
 	err := appConfig.Store.Find(&nzbs, q)
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("getting NZBs from database")
 	}
+	if wantsJSON(r) {
+		writeJSON(w, nzbs)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 	var data string
 	for _, nzb := range nzbs {
-		data = data + fmt.Sprintf("Trakt: %s\nTitle: %s\nLink: %s\nLength: %d\n", nzb.Trakt, nzb.Title, nzb.Link, nzb.Length)
+		data = data + fmt.Sprintf("Trakt: %d\nTitle: %s\nLink: %s\nLength: %d\n", nzb.Trakt, nzb.Title, nzb.Link, nzb.Length)
 	}
 	if _, err := w.Write([]byte(data)); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("writing response")
 	}
 }
+func listArchive(w http.ResponseWriter, r *http.Request, appConfig App) {
+	archived := []ArchivedMedia{}
+	q := &bolthold.Query{}
+	if err := appConfig.Store.Find(&archived, q.SortBy("ArchivedAt").Reverse()); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("getting archived medias from database")
+		http.Error(w, "Failed to get archive", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, archived)
+}
+
 func handleAPIRequests(appConfig *App) {
 	http.HandleFunc("/api/success", func(w http.ResponseWriter, r *http.Request) {
 		handleApiSuccess(w, r, *appConfig)
@@ -49,18 +126,70 @@ func handleAPIRequests(appConfig *App) {
 		handleApiFailure(w, r, *appConfig)
 	})
 	http.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
-		listMedia(w, *appConfig)
+		listMedia(w, r, *appConfig)
 	})
 	http.HandleFunc("/nzbs", func(w http.ResponseWriter, r *http.Request) {
-		listNZBs(w, *appConfig)
+		listNZBs(w, r, *appConfig)
 	})
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
+	http.HandleFunc("/api/archive", func(w http.ResponseWriter, r *http.Request) {
+		listArchive(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/cleanup/run", func(w http.ResponseWriter, r *http.Request) {
+		handleApiCleanup(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/failed", func(w http.ResponseWriter, r *http.Request) {
+		handleApiFailed(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/failed/clear", func(w http.ResponseWriter, r *http.Request) {
+		handleApiFailedClear(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/media", func(w http.ResponseWriter, r *http.Request) {
+		handleApiMedia(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/media/tags", func(w http.ResponseWriter, r *http.Request) {
+		handleApiMediaTags(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		handleApiSearch(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/media/edition", func(w http.ResponseWriter, r *http.Request) {
+		handleApiMediaEdition(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/search/preview", func(w http.ResponseWriter, r *http.Request) {
+		handleApiSearchPreview(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/admin/export", func(w http.ResponseWriter, r *http.Request) {
+		handleApiExport(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/admin/import", func(w http.ResponseWriter, r *http.Request) {
+		handleApiImport(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/admin/consistency", func(w http.ResponseWriter, r *http.Request) {
+		handleApiConsistency(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/stats/inflight", func(w http.ResponseWriter, r *http.Request) {
+		handleApiInFlight(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/stats/acquisitions", func(w http.ResponseWriter, r *http.Request) {
+		handleApiAcquisitionStats(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/stats/storage", func(w http.ResponseWriter, r *http.Request) {
+		handleApiStorageStats(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/admin/purge-failed", func(w http.ResponseWriter, r *http.Request) {
+		handleApiPurgeFailed(w, r, *appConfig)
+	})
+	http.HandleFunc("/api/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		handleApiReload(w, r, appConfig)
+	})
 	http.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
-		go func() {
-			appConfig.runTasks()
-		}()
+		if !appConfig.startTask("refreshing", appConfig.executeTasks) {
+			http.Error(w, "Tasks already running", http.StatusConflict)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write([]byte("Refresh initiated")); err != nil {
 			log.WithFields(log.Fields{"err": err}).Error("writing refresh response")
@@ -97,6 +226,11 @@ func handleApiSuccess(w http.ResponseWriter, r *http.Request, appConfig App) {
 	if _, err := w.Write([]byte(`{"message": "Data received and processing started"}`)); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("writing response")
 	}
+	if !appConfig.Tasks.Start() {
+		log.WithFields(log.Fields{"id": notification.Id}).Warning("Shutting down, not processing notification")
+		return
+	}
+	defer appConfig.Tasks.Done()
 	err = processSuccess(notification, appConfig)
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("processing notification")
@@ -126,7 +260,12 @@ func handleApiFailure(w http.ResponseWriter, r *http.Request, appConfig App) {
 		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
 		return
 	}
+	if !appConfig.Tasks.Start() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	go func() {
+		defer appConfig.Tasks.Done()
 		err := processFailure(notification, appConfig)
 		if err != nil {
 			log.WithFields(log.Fields{"err": err}).Error("processing notification")
@@ -139,3 +278,461 @@ func handleApiFailure(w http.ResponseWriter, r *http.Request, appConfig App) {
 		log.WithFields(log.Fields{"err": err}).Error("writing response")
 	}
 }
+
+func handleApiCleanup(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	started := appConfig.startTask("cleaning watched", func() {
+		if err := appConfig.refreshTraktToken(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("refreshing Trakt token")
+		}
+		if _, err := appConfig.cleanWatched(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("cleaning watched")
+		}
+	})
+	if !started {
+		http.Error(w, "Tasks already running", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if _, err := w.Write([]byte(`{"message": "Cleanup initiated"}`)); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("writing response")
+	}
+}
+
+// searchTimeout bounds how long POST /api/search waits for the search to finish. The
+// search itself carries on in the background past it.
+const searchTimeout = 2 * time.Minute
+
+func handleApiSearch(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	trakt, err := strconv.ParseInt(r.URL.Query().Get("trakt_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid trakt_id", http.StatusBadRequest)
+		return
+	}
+
+	var media Media
+	if err := appConfig.Store.Get(trakt, &media); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get media", http.StatusInternalServerError)
+		return
+	}
+
+	type result struct {
+		outcome SearchOutcome
+		err     error
+	}
+	done := make(chan result, 1)
+	started := appConfig.startTask("searching "+media.Title, func() {
+		outcome, err := appConfig.searchOne(media)
+		done <- result{outcome, err}
+	})
+	if !started {
+		http.Error(w, "Tasks already running", http.StatusConflict)
+		return
+	}
+	select {
+	case res := <-done:
+		if res.err != nil {
+			log.WithFields(log.Fields{"err": res.err}).Error("searching media")
+			http.Error(w, res.err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, res.outcome)
+	case <-time.After(searchTimeout):
+		http.Error(w, "Search still running", http.StatusGatewayTimeout)
+	}
+}
+
+func handleApiSearchPreview(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	trakt, err := strconv.ParseInt(r.URL.Query().Get("trakt_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid trakt_id", http.StatusBadRequest)
+		return
+	}
+
+	var media Media
+	if err := appConfig.Store.Get(trakt, &media); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get media", http.StatusInternalServerError)
+		return
+	}
+
+	candidates, err := appConfig.previewSearch(media)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("previewing search")
+		http.Error(w, "Search failed", http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"trakt":      media.Trakt,
+		"title":      media.Title,
+		"candidates": candidates,
+	})
+}
+
+func handleApiInFlight(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]int64{
+		"searches":  appConfig.InFlight.Searches.Load(),
+		"downloads": appConfig.InFlight.Downloads.Load(),
+	})
+}
+
+func handleApiMedia(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	trakt, err := strconv.ParseInt(r.URL.Query().Get("trakt_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid trakt_id", http.StatusBadRequest)
+		return
+	}
+
+	var media Media
+	if err := appConfig.Store.Get(trakt, &media); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get media", http.StatusInternalServerError)
+		return
+	}
+
+	nzbs := []NZB{}
+	if err := appConfig.Store.Find(&nzbs, bolthold.Where("Trakt").Eq(trakt).Index("Trakt")); err != nil {
+		http.Error(w, "Failed to get NZBs", http.StatusInternalServerError)
+		return
+	}
+
+	var progress *ShowProgress
+	if !media.IsMovie() && media.Show > 0 {
+		var showProgress ShowProgress
+		if err := appConfig.Store.Get(media.Show, &showProgress); err == nil {
+			progress = &showProgress
+		}
+	}
+
+	status := "wanted"
+	switch {
+	case media.OnDisk:
+		status = "on disk"
+	case media.DownloadID != "":
+		status = "downloading"
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"media":    media,
+		"status":   status,
+		"nzbs":     nzbs,
+		"progress": progress,
+	})
+}
+
+func handleApiReload(w http.ResponseWriter, r *http.Request, appConfig *App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(w, r, *appConfig) {
+		return
+	}
+	config, err := reloadConfig(appConfig.Config())
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("reloading configuration")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	appConfig.config.Store(config)
+	log.Info("Configuration reloaded")
+	writeJSON(w, map[string]string{"message": "Configuration reloaded"})
+}
+
+type TagsRequest struct {
+	Trakt int64    `json:"trakt_id"`
+	Tags  []string `json:"tags"`
+}
+
+func handleApiMediaTags(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request TagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+
+	media, err := appConfig.updateMediaTags(request.Trakt, request.Tags, r.Method == http.MethodPost)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		log.WithFields(log.Fields{"err": err}).Error("updating media tags")
+		http.Error(w, "Failed to update tags", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, media)
+}
+
+func handleApiFailed(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	nzbs, err := appConfig.findFailedNZBs()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("listing failed NZBs")
+		http.Error(w, "Failed to list failed NZBs", http.StatusInternalServerError)
+		return
+	}
+
+	type failedMedia struct {
+		Media Media `json:"media"`
+		NZBs  []NZB `json:"nzbs"`
+	}
+	failed := []*failedMedia{}
+	byTrakt := make(map[int64]*failedMedia)
+	for _, nzb := range nzbs {
+		entry, ok := byTrakt[nzb.Trakt]
+		if !ok {
+			entry = &failedMedia{Media: Media{Trakt: nzb.Trakt}}
+			if err := appConfig.Store.Get(nzb.Trakt, &entry.Media); err != nil && !errors.Is(err, ErrNotFound) {
+				log.WithFields(log.Fields{"err": err}).Error("getting media from database")
+			}
+			byTrakt[nzb.Trakt] = entry
+			failed = append(failed, entry)
+		}
+		entry.NZBs = append(entry.NZBs, nzb)
+	}
+	writeJSON(w, failed)
+}
+
+func handleApiFailedClear(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var trakt int64
+	if value := r.URL.Query().Get("trakt_id"); value != "" {
+		var err error
+		trakt, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid trakt_id", http.StatusBadRequest)
+			return
+		}
+	}
+	cleared, err := appConfig.clearFailedFlags(trakt)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("clearing failed NZBs")
+		http.Error(w, "Failed to clear failed NZBs", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"cleared": cleared})
+}
+
+func isAdmin(w http.ResponseWriter, r *http.Request, appConfig App) bool {
+	if appConfig.Config().AdminToken == "" {
+		http.Error(w, "ADMIN_TOKEN not configured", http.StatusForbidden)
+		return false
+	}
+	expected := "Bearer " + appConfig.Config().AdminToken
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func handleApiExport(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(w, r, appConfig) {
+		return
+	}
+	state, err := appConfig.exportState()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("exporting state")
+		http.Error(w, "Failed to export state", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="momenarr.json"`)
+	writeJSON(w, state)
+}
+
+func handleApiImport(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(w, r, appConfig) {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, "mode must be merge or replace", http.StatusBadRequest)
+		return
+	}
+
+	var state State
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+	added, err := appConfig.importState(state, mode == "replace")
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("importing state")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appConfig.searchOnAdd(added...)
+	writeJSON(w, map[string]int{
+		"media":         len(state.Media),
+		"nzbs":          len(state.NZBs),
+		"show_progress": len(state.ShowProgress),
+		"archive":       len(state.Archive),
+		"notifications": len(state.Notifications),
+		"acquisitions":  len(state.Acquisitions),
+	})
+}
+
+func handleApiConsistency(w http.ResponseWriter, r *http.Request, appConfig App) {
+	var inconsistencies []Inconsistency
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		inconsistencies, err = appConfig.checkConsistency()
+	case http.MethodPost:
+		if r.URL.Query().Get("action") != "remove" {
+			http.Error(w, "action must be remove", http.StatusBadRequest)
+			return
+		}
+		if !isAdmin(w, r, appConfig) {
+			return
+		}
+		inconsistencies, err = appConfig.removeInconsistentMedia()
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("checking database consistency")
+		http.Error(w, "Failed to check consistency", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, inconsistencies)
+}
+
+func handleApiStorageStats(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := appConfig.storageStats()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("computing storage stats")
+		http.Error(w, "Failed to compute storage stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func handleApiAcquisitionStats(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := appConfig.acquisitionStats()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("computing acquisition stats")
+		http.Error(w, "Failed to compute acquisition stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func handleApiPurgeFailed(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(w, r, appConfig) {
+		return
+	}
+	olderThan, err := time.ParseDuration(r.URL.Query().Get("older_than"))
+	if err != nil || olderThan < 0 {
+		http.Error(w, "Invalid older_than", http.StatusBadRequest)
+		return
+	}
+	purged, err := appConfig.purgeFailedNZBs(olderThan)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("purging failed NZBs")
+		http.Error(w, "Failed to purge failed NZBs", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"purged": purged})
+}
+
+type EditionRequest struct {
+	Trakt   int64  `json:"trakt_id"`
+	Edition string `json:"edition"`
+}
+
+func handleApiMediaEdition(w http.ResponseWriter, r *http.Request, appConfig App) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var request EditionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+	edition, err := normalizeEdition(request.Edition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	media, err := appConfig.setMediaEdition(request.Trakt, edition)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		log.WithFields(log.Fields{"err": err}).Error("setting media edition")
+		http.Error(w, "Failed to set edition", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, media)
+}
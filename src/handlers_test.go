@@ -0,0 +1,622 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupEndpointRunsCleanupOnce(t *testing.T) {
+	api := newFakeAPI(map[string]http.HandlerFunc{
+		"/sync/history": replyJSON([]map[string]interface{}{
+			{"id": 1, "type": "movie", "action": "watch", "watched_at": time.Now().Format(time.RFC3339), "movie": map[string]interface{}{"title": "Movie", "year": 2020, "ids": map[string]int{"trakt": 1}}},
+		}),
+	})
+	fakeTrakt(t, api)
+	dir := t.TempDir()
+	app := newTestApp(t, Config{MoviesDir: dir, HistoryWindow: time.Hour, CleanupMode: "delete"})
+	file := filepath.Join(dir, "movie.mkv")
+	if err := os.WriteFile(file, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, OnDisk: true, File: file}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleApiCleanup(w, httptest.NewRequest(http.MethodPost, "/api/cleanup/run", nil), app)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	app.Tasks.Close()
+
+	if got := api.Calls("/sync/history"); got != 1 {
+		t.Errorf("history read %d times, want 1", got)
+	}
+	if err := app.Store.Get(int64(1), &Media{}); err == nil {
+		t.Error("watched media not cleaned")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("watched file still on disk: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handleApiCleanup(w, httptest.NewRequest(http.MethodGet, "/api/cleanup/run", nil), app)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSearchPreviewRanksCandidates(t *testing.T) {
+	api := newFakeAPI(map[string]http.HandlerFunc{
+		"/api": replyFeed(
+			release("Movie.2010.1080p.WEB-DL", "https://indexer.example/getnzb/web", 5<<30),
+			release("Movie.2010.1080p.REMUX", "https://evil.example/getnzb/remux", 30<<30),
+			release("Movie.2010.2160p.REMUX", "https://indexer.example/getnzb/uhd", 60<<30),
+			release("Movie.2010.720p.CAM", "https://indexer.example/getnzb/cam", 1<<30),
+		),
+	})
+	host := fakeIndexer(t, api)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "blacklist.txt"), []byte("cam\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, Config{DataDir: dir, NewsNabHost: host, NZBAllowedHosts: []string{"indexer.example"}})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, IMDB: "tt0000001", Title: "Movie"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+	}{
+		{"known media", http.MethodGet, "trakt_id=1", http.StatusOK},
+		{"unknown media", http.MethodGet, "trakt_id=2", http.StatusNotFound},
+		{"invalid ID", http.MethodGet, "trakt_id=movie", http.StatusBadRequest},
+		{"wrong method", http.MethodPost, "trakt_id=1", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleApiSearchPreview(w, httptest.NewRequest(test.method, "/api/search/preview?"+test.query, nil), app)
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handleApiSearchPreview(w, httptest.NewRequest(http.MethodGet, "/api/search/preview?trakt_id=1", nil), app)
+	var preview struct {
+		Candidates []Candidate `json:"candidates"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, candidate := range preview.Candidates {
+		got = append(got, candidate.Title)
+	}
+	// Accepted first, then remux, web-dl and the rest
+	want := []string{"Movie.2010.2160p.REMUX", "Movie.2010.1080p.WEB-DL", "Movie.2010.1080p.REMUX", "Movie.2010.720p.CAM"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+	for i, candidate := range preview.Candidates {
+		if rejected := i >= 2; rejected != (!candidate.Accepted && candidate.Reason != "") {
+			t.Errorf("candidate %+v, want rejected with a reason: %v", candidate, rejected)
+		}
+	}
+
+	var nzbs []NZB
+	if err := app.Store.Find(&nzbs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(nzbs) != 0 {
+		t.Errorf("previewing stored %d NZBs, want none", len(nzbs))
+	}
+}
+
+func TestListMediaNegotiatesFormat(t *testing.T) {
+	app := newTestApp(t, Config{})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, IMDB: "tt0000001", Title: "Movie"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		json   bool
+	}{
+		{"default", "", "", false},
+		{"browser", "", "text/html,application/xhtml+xml", false},
+		{"accept header", "", "application/json", true},
+		{"format parameter", "?format=json", "", true},
+		{"format parameter over accept header", "?format=text", "application/json", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/list"+test.query, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+			listMedia(w, r, app)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			isJSON := w.Header().Get("Content-Type") == "application/json"
+			if isJSON != test.json {
+				t.Fatalf("Content-Type %q, want JSON: %v", w.Header().Get("Content-Type"), test.json)
+			}
+			if !test.json {
+				if !strings.Contains(w.Body.String(), "Title: Movie") {
+					t.Errorf("body %q doesn't list the media", w.Body.String())
+				}
+				return
+			}
+			var medias []Media
+			if err := json.NewDecoder(w.Body).Decode(&medias); err != nil {
+				t.Fatal(err)
+			}
+			if len(medias) != 1 || medias[0].Title != "Movie" {
+				t.Errorf("medias = %+v, want the stored media", medias)
+			}
+		})
+	}
+}
+
+func TestMediaEndpointAggregatesRelatedData(t *testing.T) {
+	app := newTestApp(t, Config{})
+	for Trakt, media := range map[int64]Media{
+		1:   {Trakt: 1, Title: "Movie", OnDisk: true},
+		101: {Trakt: 101, Show: 10, Season: 1, Number: 2, DownloadID: "SABnzbd_nzo_1"},
+		102: {Trakt: 102, Show: 10, Season: 1, Number: 3},
+	} {
+		if err := app.Store.Insert(Trakt, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nzb := range []NZB{{GUID: "a", Trakt: 101}, {GUID: "b", Trakt: 101}, {GUID: "c", Trakt: 1}} {
+		if err := app.Store.Insert(nzb.GUID, nzb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Store.Insert(int64(10), ShowProgress{Show: 10, Season: 1, Number: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		code     int
+		status   string
+		nzbs     int
+		progress bool
+	}{
+		{"movie", http.MethodGet, "trakt_id=1", http.StatusOK, "on disk", 1, false},
+		{"downloading episode", http.MethodGet, "trakt_id=101", http.StatusOK, "downloading", 2, true},
+		{"wanted episode", http.MethodGet, "trakt_id=102", http.StatusOK, "wanted", 0, true},
+		{"unknown media", http.MethodGet, "trakt_id=2", http.StatusNotFound, "", 0, false},
+		{"invalid ID", http.MethodGet, "trakt_id=", http.StatusBadRequest, "", 0, false},
+		{"wrong method", http.MethodDelete, "trakt_id=1", http.StatusMethodNotAllowed, "", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleApiMedia(w, httptest.NewRequest(test.method, "/api/media?"+test.query, nil), app)
+			if w.Code != test.code {
+				t.Fatalf("status %d, want %d", w.Code, test.code)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			var got struct {
+				Status   string        `json:"status"`
+				NZBs     []NZB         `json:"nzbs"`
+				Progress *ShowProgress `json:"progress"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != test.status || len(got.NZBs) != test.nzbs || (got.Progress != nil) != test.progress {
+				t.Errorf("got status %q, %d NZBs, progress %+v, want %q, %d NZBs, progress: %v", got.Status, len(got.NZBs), got.Progress, test.status, test.nzbs, test.progress)
+			}
+		})
+	}
+}
+
+func TestTagsFilterTheList(t *testing.T) {
+	app := newTestApp(t, Config{})
+	for _, Trakt := range []int64{1, 2, 3} {
+		if err := app.Store.Insert(Trakt, Media{Trakt: Trakt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		method string
+		body   string
+		code   int
+		tags   []string
+	}{
+		{http.MethodPost, `{"trakt_id": 1, "tags": ["Kids", " 4K-only "]}`, http.StatusOK, []string{"4k-only", "kids"}},
+		{http.MethodPost, `{"trakt_id": 2, "tags": ["kids", ""]}`, http.StatusOK, []string{"kids"}},
+		{http.MethodPost, `{"trakt_id": 2, "tags": ["kids"]}`, http.StatusOK, []string{"kids"}},
+		{http.MethodDelete, `{"trakt_id": 1, "tags": ["4k-only"]}`, http.StatusOK, []string{"kids"}},
+		{http.MethodPost, `{"trakt_id": 4, "tags": ["kids"]}`, http.StatusNotFound, nil},
+		{http.MethodPost, `kids`, http.StatusBadRequest, nil},
+		{http.MethodGet, ``, http.StatusMethodNotAllowed, nil},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		handleApiMediaTags(w, httptest.NewRequest(step.method, "/api/media/tags", strings.NewReader(step.body)), app)
+		if w.Code != step.code {
+			t.Fatalf("%s %s: status %d, want %d", step.method, step.body, w.Code, step.code)
+		}
+		if step.code != http.StatusOK {
+			continue
+		}
+		var media Media
+		if err := json.NewDecoder(w.Body).Decode(&media); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(media.Tags, step.tags) {
+			t.Errorf("%s %s: tags %v, want %v", step.method, step.body, media.Tags, step.tags)
+		}
+	}
+
+	tests := []struct {
+		tag  string
+		want []int64
+	}{
+		{"kids", []int64{1, 2}},
+		{" KIDS", []int64{1, 2}},
+		{"4k-only", nil},
+		{"", []int64{1, 2, 3}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		listMedia(w, httptest.NewRequest(http.MethodGet, "/api/list?format=json&tag="+url.QueryEscape(test.tag), nil), app)
+		var medias []Media
+		if err := json.NewDecoder(w.Body).Decode(&medias); err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, media := range medias {
+			got = append(got, media.Trakt)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("tag %q lists %v, want %v", test.tag, got, test.want)
+		}
+	}
+}
+
+func TestClearFailedNZBs(t *testing.T) {
+	app := newTestApp(t, Config{})
+	for _, Trakt := range []int64{1, 2} {
+		if err := app.Store.Insert(Trakt, Media{Trakt: Trakt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nzb := range []NZB{
+		{GUID: "a", Trakt: 1, Title: "Movie.REMUX", Length: 30 << 30, Failed: true},
+		{GUID: "b", Trakt: 1, Title: "Movie.WEB-DL", Length: 5 << 30, Failed: true},
+		{GUID: "c", Trakt: 2, Title: "Other.WEB-DL", Length: 5 << 30, Failed: true},
+	} {
+		if err := app.Store.Insert(nzb.GUID, nzb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed := func() map[int64]int {
+		w := httptest.NewRecorder()
+		handleApiFailed(w, httptest.NewRequest(http.MethodGet, "/api/failed", nil), app)
+		var entries []struct {
+			Media Media `json:"media"`
+			NZBs  []NZB `json:"nzbs"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		byTrakt := make(map[int64]int)
+		for _, entry := range entries {
+			byTrakt[entry.Media.Trakt] = len(entry.NZBs)
+		}
+		return byTrakt
+	}
+	if got, want := failed(), map[int64]int{1: 2, 2: 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("failed NZBs per media = %v, want %v", got, want)
+	}
+	if _, err := app.getNzbFromDB(1); err == nil {
+		t.Fatal("a failed NZB was picked")
+	}
+
+	tests := []struct {
+		query   string
+		code    int
+		cleared int
+		failed  map[int64]int
+	}{
+		{"?trakt_id=one", http.StatusBadRequest, 0, map[int64]int{1: 2, 2: 1}},
+		{"?trakt_id=1", http.StatusOK, 2, map[int64]int{2: 1}},
+		{"?trakt_id=1", http.StatusOK, 0, map[int64]int{2: 1}},
+		{"", http.StatusOK, 1, map[int64]int{}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handleApiFailedClear(w, httptest.NewRequest(http.MethodPost, "/api/failed/clear"+test.query, nil), app)
+		if w.Code != test.code {
+			t.Fatalf("clearing %q: status %d, want %d", test.query, w.Code, test.code)
+		}
+		if test.code == http.StatusOK {
+			var response map[string]int
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response["cleared"] != test.cleared {
+				t.Errorf("clearing %q cleared %d, want %d", test.query, response["cleared"], test.cleared)
+			}
+		}
+		if got := failed(); !reflect.DeepEqual(got, test.failed) {
+			t.Errorf("after clearing %q, failed NZBs per media = %v, want %v", test.query, got, test.failed)
+		}
+	}
+	nzb, err := app.getNzbFromDB(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nzb.GUID != "a" {
+		t.Errorf("picked %q once cleared, want the remux", nzb.GUID)
+	}
+}
+
+func TestListSortedByDownloadTime(t *testing.T) {
+	dir := t.TempDir()
+	app := newTestApp(t, Config{MoviesDir: dir})
+	now := time.Now()
+	for _, media := range []Media{
+		{Trakt: 1, DownloadID: "SABnzbd_nzo_1"},
+		{Trakt: 2, OnDisk: true, DownloadedAt: now.Add(-2 * time.Hour)},
+		{Trakt: 3, OnDisk: true, DownloadedAt: now.Add(-time.Hour)},
+		{Trakt: 4},
+	} {
+		if err := app.Store.Insert(media.Trakt, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+	completed := filepath.Join(t.TempDir(), "Movie")
+	if err := os.Mkdir(completed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(completed, "movie.mkv"), []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var media Media
+	if err := app.Store.Get(int64(1), &media); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadSuccess(Success{Id: "SABnzbd_nzo_1", Dir: completed}, app, media); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Store.Get(int64(1), &media); err != nil {
+		t.Fatal(err)
+	}
+	if media.DownloadedAt.Before(now) || media.DownloadedAt.After(time.Now()) {
+		t.Errorf("downloaded at %v, want the time the download completed", media.DownloadedAt)
+	}
+
+	tests := []struct {
+		sort string
+		code int
+		want []int64
+	}{
+		{"", http.StatusOK, []int64{1, 2, 3, 4}},
+		{"downloaded", http.StatusOK, []int64{1, 3, 2, 4}},
+		{"title", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		listMedia(w, httptest.NewRequest(http.MethodGet, "/list?format=json&sort="+test.sort, nil), app)
+		if w.Code != test.code {
+			t.Fatalf("sort %q: status %d, want %d", test.sort, w.Code, test.code)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var medias []Media
+		if err := json.NewDecoder(w.Body).Decode(&medias); err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, media := range medias {
+			got = append(got, media.Trakt)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("sort %q lists %v, want %v", test.sort, got, test.want)
+		}
+	}
+}
+
+func TestSearchEndpointDownloadsOneMedia(t *testing.T) {
+	indexer := newFakeAPI(map[string]http.HandlerFunc{
+		"/api": replyFeed(release("Movie.2010.1080p.WEB-DL", "https://indexer.example/getnzb/web", 5<<30)),
+	})
+	host := fakeIndexer(t, indexer)
+	sab := newFakeAPI(map[string]http.HandlerFunc{
+		"/api": bySABnzbdMode(map[string]http.HandlerFunc{
+			"addurl": replyJSON(map[string][]string{"nzo_ids": {"SABnzbd_nzo_new"}}),
+		}),
+	})
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "blacklist.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, Config{DataDir: dir, NewsNabHost: host})
+	app.SabNZBd = fakeSABnzbd(t, sab)
+	for _, media := range []Media{
+		{Trakt: 1, IMDB: "tt0000001"},
+		{Trakt: 2, IMDB: "tt0000002", OnDisk: true},
+		{Trakt: 3, IMDB: "tt0000003", DownloadID: "SABnzbd_nzo_3"},
+		{Trakt: 4},
+	} {
+		if err := app.Store.Insert(media.Trakt, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		code       int
+		downloadID string
+		reason     string
+	}{
+		{"wanted media", "trakt_id=1", http.StatusOK, "SABnzbd_nzo_new", ""},
+		{"media on disk", "trakt_id=2", http.StatusOK, "", "already on disk"},
+		{"media downloading", "trakt_id=3", http.StatusOK, "SABnzbd_nzo_3", "already downloading"},
+		{"media without ID", "trakt_id=4", http.StatusBadGateway, "", ""},
+		{"unknown media", "trakt_id=5", http.StatusNotFound, "", ""},
+		{"invalid ID", "trakt_id=x", http.StatusBadRequest, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleApiSearch(w, httptest.NewRequest(http.MethodPost, "/api/search?"+test.query, nil), app)
+			if w.Code != test.code {
+				t.Fatalf("status %d, want %d", w.Code, test.code)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			var outcome SearchOutcome
+			if err := json.NewDecoder(w.Body).Decode(&outcome); err != nil {
+				t.Fatal(err)
+			}
+			if outcome.DownloadID != test.downloadID || outcome.Reason != test.reason {
+				t.Errorf("outcome = %+v, want download %q and reason %q", outcome, test.downloadID, test.reason)
+			}
+		})
+	}
+	if got := indexer.Calls("/api"); got != 1 {
+		t.Errorf("indexer searched %d times, want 1", got)
+	}
+	if got := sab.Calls("/api"); got != 1 {
+		t.Errorf("SABnzbd asked for %d downloads, want 1", got)
+	}
+}
+
+func TestInFlightCountsRunningCalls(t *testing.T) {
+	searching, downloading := make(chan struct{}), make(chan struct{})
+	release := make(chan struct{})
+	host := fakeIndexer(t, newFakeAPI(map[string]http.HandlerFunc{
+		"/api": func(w http.ResponseWriter, r *http.Request) {
+			searching <- struct{}{}
+			<-release
+			replyFeed()(w, r)
+		},
+	}))
+	app := newTestApp(t, Config{NewsNabHost: host})
+	app.SabNZBd = fakeSABnzbd(t, newFakeAPI(map[string]http.HandlerFunc{
+		"/api": bySABnzbdMode(map[string]http.HandlerFunc{
+			"addurl": func(w http.ResponseWriter, r *http.Request) {
+				downloading <- struct{}{}
+				<-release
+				replyJSON(map[string][]string{"nzo_ids": {"SABnzbd_nzo_1"}})(w, r)
+			},
+		}),
+	}))
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, IMDB: "tt0000001"}); err != nil {
+		t.Fatal(err)
+	}
+	inFlight := func() map[string]int64 {
+		w := httptest.NewRecorder()
+		handleApiInFlight(w, httptest.NewRequest(http.MethodGet, "/api/stats/inflight", nil), app)
+		var counts map[string]int64
+		if err := json.NewDecoder(w.Body).Decode(&counts); err != nil {
+			t.Fatal(err)
+		}
+		return counts
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := app.searchNZB(Media{Trakt: 1, IMDB: "tt0000001"})
+		done <- err
+	}()
+	go func() {
+		done <- app.createDownload(1, NZB{GUID: "web", Trakt: 1, Link: "https://indexer.example/getnzb/web"})
+	}()
+	<-searching
+	<-downloading
+	if got, want := inFlight(), map[string]int64{"searches": 1, "downloads": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("in flight = %v, want %v", got, want)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := inFlight(), map[string]int64{"searches": 0, "downloads": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("in flight once done = %v, want %v", got, want)
+	}
+}
+
+func TestAdminEndpointsRequireTheToken(t *testing.T) {
+	endpoints := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		handler func(http.ResponseWriter, *http.Request, App)
+	}{
+		{"export", http.MethodGet, "/api/admin/export", "", handleApiExport},
+		{"import", http.MethodPost, "/api/admin/import", "{}", handleApiImport},
+		{"consistency", http.MethodPost, "/api/admin/consistency?action=remove", "", handleApiConsistency},
+		{"purge failed", http.MethodPost, "/api/admin/purge-failed?older_than=1h", "", handleApiPurgeFailed},
+		{"reload", http.MethodPost, "/api/admin/reload", "", func(w http.ResponseWriter, r *http.Request, app App) {
+			handleApiReload(w, r, &app)
+		}},
+	}
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		code          int
+	}{
+		{"token not configured", "", "Bearer ", http.StatusForbidden},
+		{"no authorization", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"token without scheme", "secret", "secret", http.StatusUnauthorized},
+		{"token prefix", "secret", "Bearer secre", http.StatusUnauthorized},
+		{"right token", "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, endpoint := range endpoints {
+		for _, test := range tests {
+			t.Run(endpoint.name+"/"+test.name, func(t *testing.T) {
+				app := newTestApp(t, Config{AdminToken: test.token, DataDir: t.TempDir()})
+				r := httptest.NewRequest(endpoint.method, endpoint.target, strings.NewReader(endpoint.body))
+				if test.authorization != "" {
+					r.Header.Set("Authorization", test.authorization)
+				}
+				w := httptest.NewRecorder()
+				endpoint.handler(w, r, app)
+				if w.Code != test.code {
+					t.Errorf("status %d, want %d: %s", w.Code, test.code, w.Body.String())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// sweepFiles checks that up to batch on disk media, starting at offset, still have their
+// file and marks the missing ones as wanted again. It returns the offset to start from next time.
+func (app App) sweepFiles(offset int, batch int) (int, error) {
+	var medias []Media
+	err := app.Store.Find(&medias, bolthold.Where("OnDisk").Eq(true).SortBy("Trakt"))
+	if err != nil {
+		return 0, fmt.Errorf("finding media on disk: %v", err)
+	}
+	if offset >= len(medias) {
+		offset = 0
+	}
+	end := len(medias)
+	if batch > 0 && offset+batch < end {
+		end = offset + batch
+	}
+
+	for _, media := range medias[offset:end] {
+		if _, err := os.Stat(media.File); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"media": media.Trakt,
+			"title": media.Title,
+			"file":  media.File,
+		}).Warning("File missing from disk, downloading it again")
+		media.OnDisk = false
+		media.File = ""
+		media.DownloadID = ""
+		media.DownloadStatus = ""
+		if err := app.Store.Update(media.Trakt, media); err != nil {
+			return 0, fmt.Errorf("updating media status in database: %v", err)
+		}
+	}
+	if end == len(medias) {
+		return 0, nil
+	}
+	return end, nil
+}
+
+func startHealthSweep(appConfig *App) {
+	offset := 0
+	for {
+		interval := appConfig.Config().HealthSweepInterval
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		// Exclusive with the other tasks, which may be moving or deleting the very files checked
+		appConfig.runExclusive(func() {
+			var err error
+			offset, err = appConfig.sweepFiles(offset, appConfig.Config().HealthSweepBatch)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Error("checking files on disk")
+			}
+		})
+	}
+}
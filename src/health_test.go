@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSweepFilesMarksMissingFilesWanted(t *testing.T) {
+	app := newTestApp(t, Config{})
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present.mkv")
+	if err := os.WriteFile(present, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for Trakt, file := range map[int64]string{1: present, 2: filepath.Join(dir, "missing.mkv"), 3: filepath.Join(dir, "gone.mkv")} {
+		media := Media{Trakt: Trakt, OnDisk: true, File: file, DownloadID: "nzo", DownloadStatus: "SUCCESS"}
+		if err := app.Store.Insert(Trakt, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first batch only checks 1 and 2, the next one starts from 3
+	offset, err := app.sweepFiles(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 2 {
+		t.Errorf("next offset = %d, want 2", offset)
+	}
+	if offset, err = app.sweepFiles(offset, 2); err != nil || offset != 0 {
+		t.Errorf("last batch = %d, %v, want to start over", offset, err)
+	}
+
+	for Trakt, want := range map[int64]bool{1: true, 2: false, 3: false} {
+		var media Media
+		if err := app.Store.Get(Trakt, &media); err != nil {
+			t.Fatal(err)
+		}
+		if media.OnDisk != want {
+			t.Errorf("media %d on disk = %v, want %v", Trakt, media.OnDisk, want)
+		}
+		if !want && (media.File != "" || media.DownloadID != "" || media.DownloadStatus != "") {
+			t.Errorf("media %d still has file %q and download %q %q", Trakt, media.File, media.DownloadID, media.DownloadStatus)
+		}
+	}
+}
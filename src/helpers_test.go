@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/amaumene/momenarr/bolthold"
+	"github.com/amaumene/momenarr/newsnab"
+	"github.com/amaumene/momenarr/sabnzbd"
+	"github.com/amaumene/momenarr/trakt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestApp returns an App with config and an empty store in a temporary directory.
+func newTestApp(t *testing.T, config Config) App {
+	t.Helper()
+	store, err := bolthold.Open(filepath.Join(t.TempDir(), "data.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	app := App{
+		Store:        store,
+		TraktToken:   &trakt.Token{AccessToken: "token", CreatedAt: time.Now(), ExpiresIn: 90 * 24 * time.Hour},
+		config:       new(atomic.Pointer[Config]),
+		Tasks:        new(TaskGroup),
+		Running:      new(sync.Mutex),
+		InFlight:     new(InFlight),
+		JSONFailures: new(atomic.Int64),
+	}
+	app.config.Store(&config)
+	return app
+}
+
+// fakeAPI answers each request with the handler registered for its path, or a 404, and
+// counts the requests per path.
+type fakeAPI struct {
+	mu     sync.Mutex
+	routes map[string]http.HandlerFunc
+	calls  map[string]int
+}
+
+func newFakeAPI(routes map[string]http.HandlerFunc) *fakeAPI {
+	return &fakeAPI{routes: routes, calls: make(map[string]int)}
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimRight(r.URL.Path, "/")
+	api.mu.Lock()
+	api.calls[path]++
+	handler, ok := api.routes[path]
+	api.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler(w, r)
+}
+
+func (api *fakeAPI) Calls(path string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.calls[path]
+}
+
+// replyJSON answers with the JSON encoding of v.
+func replyJSON(v interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// replyFeed answers with an RSS feed of items, the way an indexer answers searches.
+func replyFeed(items ...newsnab.Item) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		xml.NewEncoder(w).Encode(newsnab.Feed{Channel: newsnab.Channel{Items: items}})
+	}
+}
+
+// release returns a feed item for title, downloadable from link.
+func release(title, link string, length int64) newsnab.Item {
+	return newsnab.Item{
+		Title:     title,
+		GUID:      newsnab.GUID{Value: link},
+		Enclosure: newsnab.Enclosure{URL: link, Length: strconv.FormatInt(length, 10)},
+	}
+}
+
+// replyStatus answers with an empty body and status.
+func replyStatus(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+}
+
+// fakeTrakt points the Trakt client at api until the test ends.
+func fakeTrakt(t *testing.T, api *fakeAPI) {
+	t.Helper()
+	server := httptest.NewServer(api)
+	trakt.WithConfig(&trakt.BackendConfig{URL: server.URL, HTTPClient: server.Client()})
+	t.Cleanup(func() {
+		trakt.Production()
+		server.Close()
+	})
+}
+
+// fakeIndexer serves api over HTTPS, trusted by the default HTTP client until the test
+// ends, and returns its host.
+func fakeIndexer(t *testing.T, api *fakeAPI) string {
+	t.Helper()
+	server := httptest.NewTLSServer(api)
+	transport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		server.Close()
+	})
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+// bySABnzbdMode answers each SABnzbd API call with the handler registered for its mode.
+func bySABnzbdMode(modes map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := modes[r.URL.Query().Get("mode")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// fakeSABnzbd returns a SABnzbd client talking to api.
+func fakeSABnzbd(t *testing.T, api *fakeAPI) *sabnzbd.Client {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return sabnzbd.New(sabnzbd.Options{Addr: server.URL, ApiKey: "key"})
+}
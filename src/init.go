@@ -1,19 +1,399 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/amaumene/momenarr/sabnzbd"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+func getEnvInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number in %s: %v", name, err)
+	}
+	return number, nil
+}
+
+func getEnvBool(name string, fallback bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean in %s: %v", name, err)
+	}
+	return enabled, nil
+}
+
+func getEnvList(name string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// getEnvIDMap parses a comma separated list of old:new ID pairs.
+func getEnvIDMap(name string) (map[int64]int64, error) {
+	ids := make(map[int64]int64)
+	for _, pair := range getEnvList(name) {
+		from, to, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid %s pair %q, expected id:value", name, pair)
+		}
+		fromID, err := strconv.ParseInt(strings.TrimSpace(from), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pair %q: %v", name, pair, err)
+		}
+		toID, err := strconv.ParseInt(strings.TrimSpace(to), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pair %q: %v", name, pair, err)
+		}
+		ids[fromID] = toID
+	}
+	return ids, nil
+}
+
+func getEnvDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration in %s: %v", name, err)
+	}
+	return duration, nil
+}
+
+// configFileKeys remembers, for each key set by the config file, the environment value it
+// replaced, so a key removed from the file gets that value back on reload.
+var configFileKeys struct {
+	sync.Mutex
+	previous map[string]*string
+}
+
+// loadConfigFile sets the KEY=VALUE lines of path as environment variables, and restores
+// the variables set by a previous load whose keys are no longer in the file.
+func loadConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening config file: %v", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("closing config file")
+		}
+	}()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("invalid line in config file: %s", line)
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanning config file: %v", err)
+	}
+
+	configFileKeys.Lock()
+	defer configFileKeys.Unlock()
+	if configFileKeys.previous == nil {
+		configFileKeys.previous = make(map[string]*string)
+	}
+	for key, previous := range configFileKeys.previous {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if previous == nil {
+			err = os.Unsetenv(key)
+		} else {
+			err = os.Setenv(key, *previous)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring %s: %v", key, err)
+		}
+		delete(configFileKeys.previous, key)
+	}
+	for key, value := range values {
+		if _, ok := configFileKeys.previous[key]; !ok {
+			var previous *string
+			if current, set := os.LookupEnv(key); set {
+				previous = &current
+			}
+			configFileKeys.previous[key] = previous
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("setting %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// setRuntimeConfig reads the settings which are safe to change while running
+func setRuntimeConfig(config *Config) error {
+	var err error
+	if config.NotifyDedupWindow, err = getEnvDuration("NOTIFY_DEDUP_WINDOW", 5*time.Minute); err != nil {
+		return err
+	}
+	if config.SlowCallThreshold, err = getEnvDuration("SLOW_CALL_THRESHOLD", 10*time.Second); err != nil {
+		return err
+	}
+	config.NZBAllowedHosts = getEnvList("NZB_ALLOWED_HOSTS")
+	if config.ShutdownTimeout, err = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return err
+	}
+	if config.MaxConcurrentDownloads, err = getEnvInt("MAX_CONCURRENT_DOWNLOADS", 0); err != nil {
+		return err
+	}
+	untaggedRemuxMinGB, err := getEnvInt("UNTAGGED_REMUX_MIN_GB", 0)
+	if err != nil {
+		return err
+	}
+	config.UntaggedRemuxMinSize = int64(untaggedRemuxMinGB) << 30
+	newsNabMaxResponseMB, err := getEnvInt("NEWSNAB_MAX_RESPONSE_MB", 50)
+	if err != nil {
+		return err
+	}
+	config.NewsNabMaxResponseSize = int64(newsNabMaxResponseMB) << 20
+	cleanupFreeSpaceGB, err := getEnvInt("CLEANUP_FREE_SPACE_GB", 0)
+	if err != nil {
+		return err
+	}
+	config.CleanupFreeSpaceTarget = int64(cleanupFreeSpaceGB) << 30
+	if config.SyncInterval, err = getEnvDuration("SYNC_INTERVAL", 6*time.Hour); err != nil {
+		return err
+	}
+	if config.SyncInterval <= 0 {
+		return fmt.Errorf("SYNC_INTERVAL must be positive")
+	}
+	if config.ParallelSync, err = getEnvBool("PARALLEL_SYNC", false); err != nil {
+		return err
+	}
+	config.CleanupMode = os.Getenv("CLEANUP_MODE")
+	if config.CleanupMode == "" {
+		config.CleanupMode = "delete"
+	}
+	if config.CleanupMode != "delete" && config.CleanupMode != "archive" {
+		return fmt.Errorf("CLEANUP_MODE must be delete or archive")
+	}
+	if config.NewsNabJSON, err = getEnvBool("NEWSNAB_JSON", false); err != nil {
+		return err
+	}
+	if config.NewsNabJSONMaxFailures, err = getEnvInt("NEWSNAB_JSON_MAX_FAILURES", 2); err != nil {
+		return err
+	}
+	if config.EpisodeTitleInSearch, err = getEnvBool("EPISODE_TITLE_IN_SEARCH", false); err != nil {
+		return err
+	}
+	if config.TokenClockSkew, err = getEnvDuration("TOKEN_CLOCK_SKEW", 5*time.Minute); err != nil {
+		return err
+	}
+	config.TasksBusyMode = os.Getenv("TASKS_BUSY_MODE")
+	if config.TasksBusyMode == "" {
+		config.TasksBusyMode = "wait"
+	}
+	if config.TasksBusyMode != "wait" && config.TasksBusyMode != "busy" {
+		return fmt.Errorf("TASKS_BUSY_MODE must be wait or busy")
+	}
+	config.EpisodeSourcePrecedence = os.Getenv("EPISODE_SOURCE_PRECEDENCE")
+	if config.EpisodeSourcePrecedence == "" {
+		config.EpisodeSourcePrecedence = "favorites"
+	}
+	if config.EpisodeSourcePrecedence != "favorites" && config.EpisodeSourcePrecedence != "watchlist" {
+		return fmt.Errorf("EPISODE_SOURCE_PRECEDENCE must be favorites or watchlist")
+	}
+	if config.HealthSweepInterval, err = getEnvDuration("HEALTH_SWEEP_INTERVAL", 0); err != nil {
+		return err
+	}
+	if config.HealthSweepBatch, err = getEnvInt("HEALTH_SWEEP_BATCH", 0); err != nil {
+		return err
+	}
+	if config.MaxEpisodesPerShow, err = getEnvInt("MAX_EPISODES_PER_SHOW", 3); err != nil {
+		return err
+	}
+	if config.MaxEpisodesPerShow < 1 {
+		return fmt.Errorf("MAX_EPISODES_PER_SHOW must be at least 1")
+	}
+	if config.MaxEpisodesPerShowOverrides, err = getEnvIDMap("MAX_EPISODES_PER_SHOW_OVERRIDES"); err != nil {
+		return err
+	}
+	for show, max := range config.MaxEpisodesPerShowOverrides {
+		if max < 1 {
+			return fmt.Errorf("MAX_EPISODES_PER_SHOW_OVERRIDES for show %d must be at least 1", show)
+		}
+	}
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
+	config.CORSAllowedOrigins = getEnvList("CORS_ALLOWED_ORIGINS")
+	if config.ShowIDRemap, err = getEnvIDMap("SHOW_ID_REMAP"); err != nil {
+		return err
+	}
+	config.SMTPHost = os.Getenv("SMTP_HOST")
+	if config.SMTPPort, err = getEnvInt("SMTP_PORT", 587); err != nil {
+		return err
+	}
+	config.SMTPUser = os.Getenv("SMTP_USER")
+	config.SMTPPass = os.Getenv("SMTP_PASS")
+	config.SMTPFrom = os.Getenv("SMTP_FROM")
+	config.SMTPTo = getEnvList("SMTP_TO")
+	if config.RunSummaryMail, err = getEnvBool("RUN_SUMMARY_MAIL", false); err != nil {
+		return err
+	}
+	if config.DigestInterval, err = getEnvDuration("DIGEST_INTERVAL", 24*time.Hour); err != nil {
+		return err
+	}
+	config.WebhookURL = os.Getenv("WEBHOOK_URL")
+	if config.WebhookRetries, err = getEnvInt("WEBHOOK_RETRIES", 3); err != nil {
+		return err
+	}
+	if config.WebhookTimeout, err = getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second); err != nil {
+		return err
+	}
+	config.NewsNabMovieCategories = getEnvList("NEWSNAB_MOVIE_CATEGORIES")
+	config.NewsNabTVCategories = getEnvList("NEWSNAB_TV_CATEGORIES")
+	config.NewsNabExcludedCategories = getEnvList("NEWSNAB_EXCLUDE_CATEGORIES")
+	if config.MinReleaseAge, err = getEnvDuration("MIN_RELEASE_AGE", 0); err != nil {
+		return err
+	}
+	if config.HistoryWindow, err = getEnvDuration("CLEANUP_HISTORY_WINDOW", 5*24*time.Hour); err != nil {
+		return err
+	}
+	if config.HistoryMaxItems, err = getEnvInt("CLEANUP_HISTORY_MAX_ITEMS", 0); err != nil {
+		return err
+	}
+	if config.AvoidRetriedReleases, err = getEnvBool("AVOID_RETRIED_RELEASES", false); err != nil {
+		return err
+	}
+	if config.RequireHealthyIndexer, err = getEnvBool("REQUIRE_HEALTHY_INDEXER", false); err != nil {
+		return err
+	}
+	if config.TraktDeviceReauth, err = getEnvBool("TRAKT_DEVICE_REAUTH", false); err != nil {
+		return err
+	}
+	if config.MaxFilenameLength, err = getEnvInt("MAX_FILENAME_LENGTH", 255); err != nil {
+		return err
+	}
+	if config.RetainAcquisitions, err = getEnvBool("RETAIN_ACQUISITIONS", false); err != nil {
+		return err
+	}
+	if config.AllowMissingIMDB, err = getEnvBool("ALLOW_MISSING_IMDB", false); err != nil {
+		return err
+	}
+	if config.CompletedMinSizePercent, err = getEnvInt("COMPLETED_MIN_SIZE_PERCENT", 0); err != nil {
+		return err
+	}
+	if config.PreferredEdition, err = normalizeEdition(os.Getenv("PREFERRED_EDITION")); err != nil {
+		return fmt.Errorf("PREFERRED_EDITION: %v", err)
+	}
+	if config.SearchOnAdd, err = getEnvBool("SEARCH_ON_ADD", false); err != nil {
+		return err
+	}
+	if config.MovieSearchInterval, err = getEnvDuration("MOVIE_SEARCH_INTERVAL", 0); err != nil {
+		return err
+	}
+	if config.EpisodeSearchInterval, err = getEnvDuration("EPISODE_SEARCH_INTERVAL", 0); err != nil {
+		return err
+	}
+	if config.SearchBackoff, err = getEnvDuration("SEARCH_BACKOFF", 0); err != nil {
+		return err
+	}
+	if config.SearchBackoffMax, err = getEnvDuration("SEARCH_BACKOFF_MAX", 7*24*time.Hour); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reloadConfig re-reads the config file and environment and returns a copy of config
+// with the runtime settings updated. Settings which can't change while running are
+// checked and rejected.
+func reloadConfig(config *Config) (*Config, error) {
+	if config.File != "" {
+		if err := loadConfigFile(config.File); err != nil {
+			return nil, err
+		}
+	}
+
+	immutable := map[string]string{
+		"DOWNLOAD_DIR":     config.DownloadDir,
+		"MOVIES_DIR":       config.MoviesDir,
+		"EPISODES_DIR":     config.EpisodesDir,
+		"DATA_DIR":         config.DataDir,
+		"TRAKT_TOKEN_FILE": config.TokenFile,
+	}
+	for name, current := range immutable {
+		if value := os.Getenv(name); value != "" && value != current {
+			return nil, fmt.Errorf("%s can't be changed without a restart", name)
+		}
+	}
+
+	updated := *config
+	if value := os.Getenv("NEWSNAB_HOST"); value != "" {
+		updated.NewsNabHost = value
+	}
+	if value := os.Getenv("NEWSNAB_API_KEY"); value != "" {
+		updated.NewsNabApiKey = value
+	}
+	if err := setRuntimeConfig(&updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
 func createDir(dir string) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		log.Fatalf("Failed to create directory %s: %v", dir, err)
 	}
+	if err := checkWritable(dir); err != nil {
+		log.Fatalf("Directory %s is not writable, check its owner and permissions: %v", dir, err)
+	}
+}
+
+// checkWritable creates and removes a temporary file in dir, so permission problems
+// show up at startup instead of on the first download.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".momenarr-write-test-*")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	if err := file.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return os.Remove(name)
 }
 
 func setConfig() *Config {
 	config := new(Config)
+	config.File = os.Getenv("CONFIG_FILE")
+	if config.File != "" {
+		if err := loadConfigFile(config.File); err != nil {
+			log.WithFields(log.Fields{"err": err}).Fatal("Error loading config file")
+		}
+	}
+
 	config.NewsNabApiKey = os.Getenv("NEWSNAB_API_KEY")
 	if config.NewsNabApiKey == "" {
 		log.WithFields(log.Fields{
@@ -37,6 +417,18 @@ func setConfig() *Config {
 	// Create if it doesn't exist
 	createDir(config.DownloadDir)
 
+	config.MoviesDir = os.Getenv("MOVIES_DIR")
+	if config.MoviesDir == "" {
+		config.MoviesDir = config.DownloadDir
+	}
+	createDir(config.MoviesDir)
+
+	config.EpisodesDir = os.Getenv("EPISODES_DIR")
+	if config.EpisodesDir == "" {
+		config.EpisodesDir = config.DownloadDir
+	}
+	createDir(config.EpisodesDir)
+
 	config.DataDir = os.Getenv("DATA_DIR")
 	if config.DataDir == "" {
 		log.WithFields(log.Fields{
@@ -44,6 +436,22 @@ func setConfig() *Config {
 		}).Warning("DATA_DIR not set, using current directory")
 		config.DataDir = "."
 	}
+	createDir(config.DataDir)
+
+	config.TokenFile = os.Getenv("TRAKT_TOKEN_FILE")
+	if config.TokenFile == "" {
+		config.TokenFile = filepath.Join(config.DataDir, "token.json")
+	}
+	createDir(filepath.Dir(config.TokenFile))
+
+	var err error
+	if config.DBOpenTimeout, err = getEnvDuration("DB_OPEN_TIMEOUT", time.Minute); err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Invalid configuration")
+	}
+
+	if err := setRuntimeConfig(config); err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Invalid configuration")
+	}
 	return config
 }
 
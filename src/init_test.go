@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	config := &Config{DownloadDir: "/downloads", NewsNabHost: "old.example.com"}
+
+	t.Setenv("NEWSNAB_HOST", "new.example.com")
+	t.Setenv("SHUTDOWN_TIMEOUT", "1m")
+	updated, err := reloadConfig(config)
+	if err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	if updated.NewsNabHost != "new.example.com" || updated.ShutdownTimeout != time.Minute {
+		t.Errorf("reloaded host %q and timeout %v", updated.NewsNabHost, updated.ShutdownTimeout)
+	}
+	if config.NewsNabHost != "old.example.com" {
+		t.Errorf("reloadConfig changed the current config to %q", config.NewsNabHost)
+	}
+
+	t.Setenv("DOWNLOAD_DIR", "/elsewhere")
+	if _, err := reloadConfig(config); err == nil {
+		t.Error("reloadConfig accepted a new DOWNLOAD_DIR")
+	}
+}
+
+func TestMaxEpisodesPerShowOverrides(t *testing.T) {
+	t.Setenv("MAX_EPISODES_PER_SHOW", "3")
+	t.Setenv("MAX_EPISODES_PER_SHOW_OVERRIDES", "1390:10, 2000:1")
+	var config Config
+	if err := setRuntimeConfig(&config); err != nil {
+		t.Fatalf("setRuntimeConfig: %v", err)
+	}
+	for show, want := range map[int64]int{1390: 10, 2000: 1, 3000: 3} {
+		if got := config.maxEpisodesFor(show); got != want {
+			t.Errorf("maxEpisodesFor(%d) = %d, want %d", show, got, want)
+		}
+	}
+
+	t.Setenv("MAX_EPISODES_PER_SHOW_OVERRIDES", "1390:0")
+	if err := setRuntimeConfig(&config); err == nil {
+		t.Error("setRuntimeConfig accepted an override of 0")
+	}
+}
+
+func TestReloadConfigForgetsKeysRemovedFromFile(t *testing.T) {
+	// Restored by t.Setenv once the test is over, whatever the config file did with them
+	t.Setenv("SHUTDOWN_TIMEOUT", "")
+	t.Setenv("SLOW_CALL_THRESHOLD", "5s")
+	file := filepath.Join(t.TempDir(), "momenarr.env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		write("")
+		loadConfigFile(file)
+	})
+	config := &Config{File: file}
+
+	write("SHUTDOWN_TIMEOUT=1m\nSLOW_CALL_THRESHOLD=20s\n")
+	updated, err := reloadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ShutdownTimeout != time.Minute || updated.SlowCallThreshold != 20*time.Second {
+		t.Errorf("loaded timeout %v and threshold %v, want 1m and 20s", updated.ShutdownTimeout, updated.SlowCallThreshold)
+	}
+
+	write("# both removed\n")
+	if updated, err = reloadConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if updated.ShutdownTimeout != 30*time.Second {
+		t.Errorf("timeout removed from the file = %v, want the 30s default", updated.ShutdownTimeout)
+	}
+	if updated.SlowCallThreshold != 5*time.Second {
+		t.Errorf("threshold removed from the file = %v, want the 5s from the environment", updated.SlowCallThreshold)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	readOnly := filepath.Join(dir, "read-only")
+	if err := os.Mkdir(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		writable bool
+	}{
+		{"writable directory", dir, true},
+		{"missing directory", filepath.Join(dir, "missing"), false},
+		{"file", file, false},
+		{"read-only directory", readOnly, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.dir == readOnly && os.Geteuid() == 0 {
+				t.Skip("root can write to read-only directories")
+			}
+			err := checkWritable(test.dir)
+			if (err == nil) != test.writable {
+				t.Errorf("checkWritable = %v, want writable: %v", err, test.writable)
+			}
+		})
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("checking left %d entries in the directory, want 2", len(entries))
+	}
+}
+
+func TestEpisodeSourcePrecedenceSetting(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "favorites", false},
+		{"favorites", "favorites", false},
+		{"watchlist", "watchlist", false},
+		{"history", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("EPISODE_SOURCE_PRECEDENCE", test.value)
+			var config Config
+			err := setRuntimeConfig(&config)
+			if test.wantErr {
+				if err == nil {
+					t.Error("setRuntimeConfig accepted an unknown precedence")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.EpisodeSourcePrecedence != test.want {
+				t.Errorf("precedence = %q, want %q", config.EpisodeSourcePrecedence, test.want)
+			}
+		})
+	}
+}
@@ -2,43 +2,111 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/amaumene/momenarr/bolthold"
 	"github.com/amaumene/momenarr/sabnzbd"
 	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 func (app App) createDownload(Trakt int64, nzb NZB) error {
 	var media Media
 	if err := app.Store.Get(Trakt, &media); err != nil {
-		return fmt.Errorf("getting media from database: %s", err)
+		return fmt.Errorf("getting media from database: %w", err)
 	}
 	if media.DownloadID == "" {
+		allowed, err := app.isAllowedNZBHost(nzb.Link)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			log.WithFields(log.Fields{
+				"TraktID": Trakt,
+				"Title":   nzb.Title,
+				"Link":    nzb.Link,
+			}).Warning("Refusing NZB link to a host not in NZB_ALLOWED_HOSTS")
+			// Marked failed so the next run picks another release instead of this one again
+			nzb.Failed = true
+			nzb.FailedAt = time.Now()
+			if err := app.Store.Update(nzb.GUID, nzb); err != nil {
+				return fmt.Errorf("updating NZB record: %v", err)
+			}
+			return fmt.Errorf("NZB link host not allowed: %s", nzb.Link)
+		}
+		app.InFlight.Downloads.Add(1)
+		defer app.InFlight.Downloads.Add(-1)
 		ctx := context.Background()
-		response, err := app.SabNZBd.AddFromUrl(ctx, sabnzbd.AddNzbRequest{Url: nzb.Link, Category: "momenarr"})
+		var response *sabnzbd.AddFileResponse
+		err = app.timeCall("sabnzbd.AddFromUrl", func() error {
+			var err error
+			response, err = app.SabNZBd.AddFromUrl(ctx, sabnzbd.AddNzbRequest{Url: nzb.Link, Category: "momenarr"})
+			return err
+		})
 		if err != nil {
 			return fmt.Errorf("creating NZB transfer: %s", err)
 		}
+		if len(response.NzoIDs) == 0 {
+			// SABnzbd didn't create a job, most likely because this NZB is already queued
+			nzoID, err := app.findQueuedDownload(ctx, nzb.Title)
+			if err != nil {
+				return fmt.Errorf("no NZB transfer created (%s): %v", response.ErrorMsg, err)
+			}
+			log.WithFields(log.Fields{
+				"TraktID":    Trakt,
+				"Title":      nzb.Title,
+				"DownloadID": nzoID,
+			}).Info("NZB already in SABnzbd queue, tracking existing download")
+			response.NzoIDs = []string{nzoID}
+		}
 
-		err = updateMediaDownloadID(app.Store, Trakt, response.NzoIDs)
+		err = updateMediaDownloadID(app.Store, Trakt, response.NzoIDs, nzb.GUID)
 		if err != nil {
 			return fmt.Errorf("updating DownloadID in database: %s", err)
 		}
 		logDownloadStart(Trakt, nzb.Title, response.NzoIDs)
+		app.emit(EventDownloadStarted, media, nzb.Title)
 	}
 	return nil
 }
 
-func updateMediaDownloadID(store *bolthold.Store, Trakt int64, downloadID []string) error {
+func (app App) findQueuedDownload(ctx context.Context, title string) (string, error) {
+	var queue *sabnzbd.QueueResponse
+	err := app.timeCall("sabnzbd.Queue", func() error {
+		var err error
+		queue, err = app.SabNZBd.Queue(ctx)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("getting SABnzbd queue: %v", err)
+	}
+	for _, slot := range queue.Queue.Slots {
+		if strings.EqualFold(strings.TrimSuffix(slot.Filename, ".nzb"), title) {
+			return slot.NzoID, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in SABnzbd queue", title)
+}
+
+func updateMediaDownloadID(store *bolthold.Store, Trakt int64, downloadID []string, release string) error {
 	var media Media
 	if err := store.Get(Trakt, &media); err != nil {
 		return fmt.Errorf("getting media from database: %w", err)
 	}
 	media.DownloadID = downloadID[0]
+	media.DownloadStatus = ""
+	if release != "" && !slices.Contains(media.TriedReleases, release) {
+		media.TriedReleases = append(media.TriedReleases, release)
+	}
 	return store.Update(Trakt, media)
 }
 
@@ -50,12 +118,32 @@ func logDownloadStart(Trakt int64, title string, downloadID []string) {
 	}).Info("Download started successfully")
 }
 
-func (app App) downloadNotOnDisk() error {
+// downloadNotOnDisk sends the media not on disk to SABnzbd and returns how many
+// downloads it started.
+func (app App) downloadNotOnDisk() (int, error) {
 	medias, err := findMediasNotOnDisk(app.Store)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	started := 0
+	active := 0
 	for _, media := range medias {
+		if media.DownloadID != "" {
+			active++
+		}
+	}
+	for _, media := range medias {
+		if media.DownloadID != "" {
+			continue
+		}
+		if app.Config().MaxConcurrentDownloads > 0 && active >= app.Config().MaxConcurrentDownloads {
+			log.WithFields(log.Fields{
+				"media":  media.Trakt,
+				"title":  media.Title,
+				"active": active,
+			}).Info("Too many downloads in progress, deferring download")
+			continue
+		}
 		err = app.processMediaDownload(media)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -63,9 +151,12 @@ func (app App) downloadNotOnDisk() error {
 				"media": media.Trakt,
 				"title": media.Title,
 			}).Error("No NZB found for media")
+			continue
 		}
+		active++
+		started++
 	}
-	return nil
+	return started, nil
 }
 
 func findMediasNotOnDisk(store *bolthold.Store) ([]Media, error) {
@@ -89,22 +180,50 @@ func (app App) processMediaDownload(media Media) error {
 	return nil
 }
 
-func (app App) syncFromTrakt() {
-	err, movies := app.syncMoviesFromTrakt()
-	if err != nil {
+// syncFromTrakt adds the medias from the Trakt lists and, when prune is set, removes the
+// ones no longer there.
+func (app App) syncFromTrakt(prune bool, summary *RunSummary) {
+	var movies, episodes []interface{}
+	var moviesErr, episodesErr error
+	if app.Config().ParallelSync {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			moviesErr, movies = app.syncMoviesFromTrakt()
+		}()
+		go func() {
+			defer wg.Done()
+			episodesErr, episodes = app.syncEpisodesFromTrakt()
+		}()
+		wg.Wait()
+	} else {
+		moviesErr, movies = app.syncMoviesFromTrakt()
+		episodesErr, episodes = app.syncEpisodesFromTrakt()
+	}
+	if moviesErr != nil {
 		log.WithFields(log.Fields{
-			"err": err,
+			"err": moviesErr,
 		}).Error("Error syncing movies from Trakt")
 	}
-	err, episodes := app.syncEpisodesFromTrakt()
-	if err != nil {
+	if episodesErr != nil {
 		log.WithFields(log.Fields{
-			"err": err,
+			"err": episodesErr,
 		}).Error("Error syncing episodes from Trakt")
 	}
+	// An empty list is a legitimately empty account, but a failed sync must not remove everything it didn't return
+	if moviesErr != nil || episodesErr != nil {
+		log.Warning("Trakt sync failed, keeping existing media entries")
+		summary.Failed++
+		return
+	}
+	summary.Synced = len(movies) + len(episodes)
+	if !prune {
+		return
+	}
 	merged := append(movies, episodes...)
 	var existingEntries []Media
-	err = app.Store.Find(&existingEntries, bolthold.Where("Trakt").Not().ContainsAny(merged...))
+	err := app.Store.Find(&existingEntries, bolthold.Where("Trakt").Not().ContainsAny(merged...))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -113,39 +232,172 @@ func (app App) syncFromTrakt() {
 	for _, entry := range existingEntries {
 		app.removeMedia(entry.Trakt)
 	}
+	summary.Pruned = len(existingEntries)
+}
+
+// startTask runs task in the background once no other task is running. In busy mode it
+// returns false straight away instead of waiting when another task is running.
+func (app App) startTask(name string, task func()) bool {
+	wait := app.Config().TasksBusyMode != "busy"
+	if !wait && !app.Running.TryLock() {
+		return false
+	}
+	if !app.Tasks.Start() {
+		if !wait {
+			app.Running.Unlock()
+		}
+		return false
+	}
+	go func() {
+		defer app.Tasks.Done()
+		if wait {
+			app.Running.Lock()
+		}
+		defer app.Running.Unlock()
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.WithFields(log.Fields{"panic": rec}).Error(name)
+			}
+		}()
+		task()
+	}()
+	return true
 }
 
 func (app App) runTasks() {
-	app.syncFromTrakt()
-	if err := app.populateNZB(); err != nil {
+	app.runExclusive(app.executeTasks)
+}
+
+func (app App) runExclusive(task func()) {
+	if !app.Tasks.Start() {
+		return
+	}
+	defer app.Tasks.Done()
+
+	if app.Config().TasksBusyMode == "busy" {
+		if !app.Running.TryLock() {
+			log.Info("Tasks already running, skipping this run")
+			return
+		}
+	} else {
+		app.Running.Lock()
+	}
+	defer app.Running.Unlock()
+	task()
+}
+
+func (app App) executeSearch() {
+	app.searchAndDownload(new(RunSummary), true)
+}
+
+// searchAndDownload searches the medias due and downloads the best releases found. Between
+// syncs, only the medias with a search interval of their own are searched.
+func (app App) searchAndDownload(summary *RunSummary, betweenSyncs bool) {
+	app.JSONFailures.Store(0)
+	if err := app.populateNZB(betweenSyncs); err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("populating NZB")
+		summary.Failed++
 	}
-	if err := app.downloadNotOnDisk(); err != nil {
+	started, err := app.downloadNotOnDisk()
+	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("downloading on disk")
+		summary.Failed++
 	}
-	err := app.cleanWatched()
-	if err != nil {
+	summary.Downloaded = started
+}
+
+func (app App) executeTasks() {
+	summary := &RunSummary{StartedAt: time.Now()}
+	if err := app.refreshTraktToken(); err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Error("cleaning watched")
+		}).Error("refreshing Trakt token")
+		summary.Failed++
+	}
+	// With the indexer down, nothing removed now could be downloaded again, so removals wait for a healthy run
+	healthy := !app.Config().RequireHealthyIndexer || app.indexerHealthy()
+	app.syncFromTrakt(healthy, summary)
+	app.searchAndDownload(summary, false)
+	if healthy {
+		cleaned, err := app.cleanWatched()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("cleaning watched")
+			summary.Failed++
+		}
+		summary.Cleaned = cleaned
+	} else {
+		log.Warning("Indexer unhealthy, skipping cleanup")
 	}
-	log.Info("Tasks ran successfully")
+	if _, err := app.pruneNotifications(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("pruning notifications")
+	}
+	app.reportRun(summary)
 }
 
 func startBackgroundTasks(appConfig *App) {
 	for {
 		appConfig.runTasks()
-		time.Sleep(6 * time.Hour)
+		time.Sleep(appConfig.Config().SyncInterval)
+	}
+}
+
+// startSearchLoop searches and downloads between syncs, as often as the shortest of
+// MOVIE_SEARCH_INTERVAL and EPISODE_SEARCH_INTERVAL.
+func startSearchLoop(appConfig *App) {
+	for {
+		interval := appConfig.Config().searchLoopInterval()
+		if interval <= 0 || interval >= appConfig.Config().SyncInterval {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		appConfig.runExclusive(appConfig.executeSearch)
+	}
+}
+
+// openStore opens the database at path, waiting up to timeout for another process to
+// release it, or forever when timeout is 0.
+func openStore(path string, timeout time.Duration) (*bolthold.Store, error) {
+	// Another process holding the database, like a viewer, has the file locked until it exits
+	boltOptions := *bolt.DefaultOptions
+	boltOptions.Timeout = timeout
+	return bolthold.Open(path, 0666, &bolthold.Options{Options: &boltOptions})
+}
+
+func drainTasks(appConfig *App) {
+	done := make(chan struct{})
+	go func() {
+		appConfig.Tasks.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Info("All running tasks finished")
+	case <-time.After(appConfig.Config().ShutdownTimeout):
+		log.WithFields(log.Fields{
+			"timeout": appConfig.Config().ShutdownTimeout,
+		}).Warning("Tasks still running after shutdown timeout, downloads already sent to SABnzbd will resume on next start")
 	}
 }
 
-func handleShutdown(appConfig *App, shutdownChan chan os.Signal) {
+func handleShutdown(appConfig *App, server *http.Server, shutdownChan chan os.Signal) {
 	<-shutdownChan
 	log.Info("Received shutdown signal, shutting down gracefully...")
+	// Stop taking requests first, so none can start a task while they are drained
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.Config().ShutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warning("Requests still running after shutdown timeout")
+	}
+	cancel()
+	drainTasks(appConfig)
 	if err := appConfig.Store.Close(); err != nil {
 		log.Error("Error closing database: ", err)
 	}
@@ -156,25 +408,46 @@ func handleShutdown(appConfig *App, shutdownChan chan os.Signal) {
 func main() {
 	log.SetOutput(os.Stdout)
 	app := new(App)
-	app.Config = setConfig()
+	app.config = new(atomic.Pointer[Config])
+	app.config.Store(setConfig())
+	app.Tasks = new(TaskGroup)
+	app.Running = new(sync.Mutex)
+	app.InFlight = new(InFlight)
+	app.JSONFailures = new(atomic.Int64)
 	traktApiKey, traktClientSecret := getEnvTrakt()
+	app.Config().TraktClientSecret = traktClientSecret
 	app.TraktToken = app.setUpTrakt(traktApiKey, traktClientSecret)
 	app.SabNZBd = setSabNZBd()
 
 	var err error
-	app.Store, err = bolthold.Open(app.Config.DataDir+"/data.db", 0666, nil)
+	app.Store, err = openStore(app.Config().DataDir+"/data.db", app.Config().DBOpenTimeout)
+	if errors.Is(err, bolt.ErrTimeout) {
+		log.WithFields(log.Fields{
+			"timeout": app.Config().DBOpenTimeout,
+		}).Fatal("Database still locked by another process after DB_OPEN_TIMEOUT")
+	}
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Fatal("Error opening database")
 	}
 
-	shutdownChan := make(chan os.Signal, 1)
-	signal.Notify(shutdownChan, os.Interrupt)
-	go handleShutdown(app, shutdownChan)
-
 	go startBackgroundTasks(app)
+	go startHealthSweep(app)
+	go startSearchLoop(app)
+	go startDigest(app)
 
 	handleAPIRequests(app)
+	handler := chain(http.DefaultServeMux, recoverMiddleware, corsMiddleware(app))
 	port := "0.0.0.0:3000"
-	log.Fatal(http.ListenAndServe(port, nil))
+	server := &http.Server{Addr: port, Handler: handler}
+
+	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
+	go handleShutdown(app, server, shutdownChan)
+
 	log.WithFields(log.Fields{"port": port}).Info("Server is running")
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// handleShutdown exits once the tasks are drained and the database closed
+	select {}
 }
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amaumene/momenarr/sabnzbd"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTaskGroupRefusesWorkOnceClosed(t *testing.T) {
+	tasks := new(TaskGroup)
+	if !tasks.Start() {
+		t.Fatal("starting work before shutdown was refused")
+	}
+	closed := make(chan struct{})
+	go func() {
+		tasks.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while work was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Close has marked the group closed by now
+	for !tasks.closedForTest() {
+		time.Sleep(time.Millisecond)
+	}
+	if tasks.Start() {
+		t.Error("work started during shutdown")
+	}
+	tasks.Done()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't return once the work was done")
+	}
+}
+
+func (tasks *TaskGroup) closedForTest() bool {
+	tasks.mu.Lock()
+	defer tasks.mu.Unlock()
+	return tasks.closed
+}
+
+func TestStartTaskRefusedDuringShutdown(t *testing.T) {
+	app := newTestApp(t, Config{})
+	app.Tasks.Close()
+	ran := false
+	if app.startTask("test", func() { ran = true }) {
+		t.Error("task started during shutdown")
+	}
+	if ran {
+		t.Error("task ran during shutdown")
+	}
+}
+
+func TestDisallowedNZBHostFallsBackToNextRelease(t *testing.T) {
+	app := newTestApp(t, Config{NZBAllowedHosts: []string{"indexer.example"}})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, nzb := range []NZB{
+		{GUID: "remux", Trakt: 1, Title: "Movie.2010.1080p.REMUX", Length: 30 << 30, Link: "https://evil.example/getnzb/1"},
+		{GUID: "web", Trakt: 1, Title: "Movie.2010.1080p.WEB-DL", Length: 5 << 30, Link: "https://indexer.example/getnzb/2"},
+	} {
+		if err := app.Store.Insert(nzb.GUID, nzb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := app.processMediaDownload(Media{Trakt: 1}); err == nil {
+		t.Fatal("downloading from a host not in NZB_ALLOWED_HOSTS succeeded")
+	}
+	var refused NZB
+	if err := app.Store.Get("remux", &refused); err != nil {
+		t.Fatal(err)
+	}
+	if !refused.Failed {
+		t.Error("the refused NZB isn't marked failed")
+	}
+	next, err := app.getNzbFromDB(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.GUID != "web" {
+		t.Errorf("next NZB = %q, want web", next.GUID)
+	}
+}
+
+func TestMaxConcurrentDownloadsDefersNewDownloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		started int
+	}{
+		{"no limit", 0, 3},
+		{"room for one more", 2, 1},
+		{"at the limit", 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(map[string]http.HandlerFunc{
+				"/api": bySABnzbdMode(map[string]http.HandlerFunc{
+					"addurl": replyJSON(map[string][]string{"nzo_ids": {"SABnzbd_nzo_new"}}),
+				}),
+			})
+			app := newTestApp(t, Config{MaxConcurrentDownloads: test.max})
+			app.SabNZBd = fakeSABnzbd(t, api)
+			if err := app.Store.Insert(int64(1), Media{Trakt: 1, DownloadID: "SABnzbd_nzo_active"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, Trakt := range []int64{2, 3, 4} {
+				if err := app.Store.Insert(Trakt, Media{Trakt: Trakt}); err != nil {
+					t.Fatal(err)
+				}
+				guid := fmt.Sprint(Trakt)
+				nzb := NZB{GUID: guid, Trakt: Trakt, Title: "Movie." + guid, Length: 1 << 30, Link: "https://indexer.example/getnzb/" + guid}
+				if err := app.Store.Insert(guid, nzb); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			started, err := app.downloadNotOnDisk()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if started != test.started {
+				t.Errorf("started %d downloads, want %d", started, test.started)
+			}
+			if got := api.Calls("/api"); got != test.started {
+				t.Errorf("SABnzbd asked for %d downloads, want %d", got, test.started)
+			}
+		})
+	}
+}
+
+// movieEntry is a movie in a Trakt favorites or watchlist page.
+func movieEntry(Trakt int, imdb string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "movie",
+		"movie": map[string]interface{}{"title": imdb, "year": 2020, "ids": map[string]interface{}{"trakt": Trakt, "imdb": imdb}},
+	}
+}
+
+func TestSyncFromTraktPrunesOnlyAfterSuccess(t *testing.T) {
+	empty := replyJSON([]interface{}{})
+	tests := []struct {
+		name      string
+		favorites http.HandlerFunc
+		kept      bool
+		synced    int
+		failed    int
+	}{
+		{"empty account", empty, false, 0, 0},
+		{"movie still listed", replyJSON([]interface{}{movieEntry(1, "tt1")}), true, 1, 0},
+		{"failed sync", replyStatus(http.StatusInternalServerError), true, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeTrakt(t, newFakeAPI(map[string]http.HandlerFunc{
+				"/sync/watchlist/movies": empty,
+				"/sync/favorites/movies": test.favorites,
+				"/sync/watchlist/shows":  empty,
+				"/sync/favorites/shows":  empty,
+			}))
+			app := newTestApp(t, Config{})
+			if err := app.Store.Insert(int64(1), Media{Trakt: 1, IMDB: "tt1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var summary RunSummary
+			app.syncFromTrakt(true, &summary)
+			err := app.Store.Get(int64(1), &Media{})
+			if kept := err == nil; kept != test.kept {
+				t.Errorf("media kept: %v, want %v", kept, test.kept)
+			}
+			if summary.Synced != test.synced || summary.Failed != test.failed {
+				t.Errorf("summary = %+v, want %d synced and %d failed", summary, test.synced, test.failed)
+			}
+		})
+	}
+}
+
+func TestParallelSyncMatchesSequentialSync(t *testing.T) {
+	tests := []struct {
+		name     string
+		parallel bool
+	}{
+		{"sequential", false},
+		{"parallel", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			empty := replyJSON([]interface{}{})
+			fakeTrakt(t, newFakeAPI(map[string]http.HandlerFunc{
+				"/sync/watchlist/movies":     replyJSON([]interface{}{movieEntry(1, "tt1")}),
+				"/sync/favorites/movies":     replyJSON([]interface{}{movieEntry(2, "tt2")}),
+				"/sync/watchlist/shows":      replyJSON([]interface{}{showEntry(10, "tt10")}),
+				"/sync/favorites/shows":      empty,
+				"/shows/10/progress/watched": replyJSON(map[string]interface{}{"next_episode": episodeJSON(101, 1, 1)}),
+			}))
+			app := newTestApp(t, Config{ParallelSync: test.parallel})
+			// Pruned unless the sync returns it
+			if err := app.Store.Insert(int64(3), Media{Trakt: 3, IMDB: "tt3"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var summary RunSummary
+			app.syncFromTrakt(true, &summary)
+			if summary.Synced != 3 || summary.Pruned != 1 || summary.Failed != 0 {
+				t.Errorf("summary = %+v, want 3 synced and 1 pruned", summary)
+			}
+			for _, Trakt := range []int64{1, 2, 101} {
+				if err := app.Store.Get(Trakt, &Media{}); err != nil {
+					t.Errorf("media %d not synced: %v", Trakt, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAlreadyQueuedNZBIsTracked(t *testing.T) {
+	queue := func(slots ...sabnzbd.QueueSlot) http.HandlerFunc {
+		return replyJSON(sabnzbd.QueueResponse{Queue: sabnzbd.Queue{Slots: slots}})
+	}
+	tests := []struct {
+		name       string
+		queue      http.HandlerFunc
+		downloadID string
+	}{
+		{"queued", queue(sabnzbd.QueueSlot{NzoID: "SABnzbd_nzo_other", Filename: "Other.Movie"}, sabnzbd.QueueSlot{NzoID: "SABnzbd_nzo_1", Filename: "movie.2010.1080p.web-dl.nzb"}), "SABnzbd_nzo_1"},
+		{"not queued", queue(sabnzbd.QueueSlot{NzoID: "SABnzbd_nzo_other", Filename: "Other.Movie"}), ""},
+		{"queue unavailable", replyStatus(http.StatusInternalServerError), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(map[string]http.HandlerFunc{
+				"/api": bySABnzbdMode(map[string]http.HandlerFunc{
+					"addurl": replyJSON(map[string]interface{}{"nzo_ids": []string{}, "error": "duplicate NZB"}),
+					"queue":  test.queue,
+				}),
+			})
+			app := newTestApp(t, Config{})
+			app.SabNZBd = fakeSABnzbd(t, api)
+			if err := app.Store.Insert(int64(1), Media{Trakt: 1}); err != nil {
+				t.Fatal(err)
+			}
+			nzb := NZB{GUID: "web", Trakt: 1, Title: "Movie.2010.1080p.WEB-DL", Link: "https://indexer.example/getnzb/web"}
+
+			err := app.createDownload(1, nzb)
+			if (err == nil) != (test.downloadID != "") {
+				t.Errorf("creating the download: %v", err)
+			}
+			var media Media
+			if err := app.Store.Get(int64(1), &media); err != nil {
+				t.Fatal(err)
+			}
+			if media.DownloadID != test.downloadID {
+				t.Errorf("DownloadID = %q, want %q", media.DownloadID, test.downloadID)
+			}
+		})
+	}
+}
+
+func TestTasksNeverRunConcurrently(t *testing.T) {
+	tests := []struct {
+		mode string
+		ran  int
+	}{
+		{"wait", 3},
+		{"busy", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			app := newTestApp(t, Config{TasksBusyMode: test.mode})
+			var running, overlapped, ran atomic.Int32
+			release := make(chan struct{})
+			task := func() {
+				if running.Add(1) > 1 {
+					overlapped.Add(1)
+				}
+				<-release
+				running.Add(-1)
+				ran.Add(1)
+			}
+			if !app.startTask("first", task) {
+				t.Fatal("first task refused")
+			}
+			for running.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			if started := app.startTask("second", task); started != (test.mode == "wait") {
+				t.Errorf("second task started: %v", started)
+			}
+			done := make(chan struct{})
+			go func() {
+				app.runExclusive(task)
+				close(done)
+			}()
+			if test.mode == "busy" {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatal("exclusive run waited in busy mode")
+				}
+			}
+			close(release)
+			<-done
+			app.Tasks.Close()
+
+			if got := ran.Load(); got != int32(test.ran) {
+				t.Errorf("%d tasks ran, want %d", got, test.ran)
+			}
+			if overlapped.Load() > 0 {
+				t.Error("tasks ran concurrently")
+			}
+		})
+	}
+}
+
+func TestListsAreRequestedByType(t *testing.T) {
+	api := newFakeAPI(map[string]http.HandlerFunc{
+		"/sync/watchlist/movies":     replyJSON([]interface{}{movieEntry(1, "tt1")}),
+		"/sync/favorites/movies":     replyJSON([]interface{}{movieEntry(2, "tt2")}),
+		"/sync/watchlist/shows":      replyJSON([]interface{}{showEntry(10, "tt10")}),
+		"/sync/favorites/shows":      replyJSON([]interface{}{showEntry(20, "tt20")}),
+		"/shows/10/progress/watched": replyJSON(map[string]interface{}{"next_episode": episodeJSON(101, 1, 1)}),
+		"/shows/20/progress/watched": replyJSON(map[string]interface{}{}),
+	})
+	fakeTrakt(t, api)
+	app := newTestApp(t, Config{})
+
+	tests := []struct {
+		name string
+		path string
+		sync func() (error, []interface{})
+		want []interface{}
+	}{
+		{"movies watchlist", "/sync/watchlist/movies", app.syncMoviesFromWatchlist, []interface{}{int64(1)}},
+		{"movies favorites", "/sync/favorites/movies", app.syncMoviesFromFavorites, []interface{}{int64(2)}},
+		{"shows watchlist", "/sync/watchlist/shows", func() (error, []interface{}) {
+			return app.syncEpisodesFromWatchlist(make(map[int64]bool))
+		}, []interface{}{int64(101)}},
+		{"shows favorites", "/sync/favorites/shows", func() (error, []interface{}) {
+			return app.syncEpisodesFromFavorites(make(map[int64]bool))
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err, synced := test.sync()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(synced, test.want) {
+				t.Errorf("synced %v, want %v", synced, test.want)
+			}
+			if got := api.Calls(test.path); got != 1 {
+				t.Errorf("%s requested %d times, want 1", test.path, got)
+			}
+		})
+	}
+}
+
+func TestUnhealthyIndexerSkipsRemovals(t *testing.T) {
+	tests := []struct {
+		name    string
+		require bool
+		status  int
+		removed bool
+	}{
+		{"health not required", false, http.StatusServiceUnavailable, true},
+		{"healthy indexer", true, http.StatusOK, true},
+		{"unhealthy indexer", true, http.StatusServiceUnavailable, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			empty := replyJSON([]interface{}{})
+			fakeTrakt(t, newFakeAPI(map[string]http.HandlerFunc{
+				"/sync/watchlist/movies": empty,
+				"/sync/favorites/movies": empty,
+				"/sync/watchlist/shows":  empty,
+				"/sync/favorites/shows":  empty,
+				"/sync/history": replyJSON([]map[string]interface{}{
+					{"id": 1, "type": "movie", "action": "watch", "watched_at": time.Now().Format(time.RFC3339), "movie": map[string]interface{}{"title": "Movie", "year": 2020, "ids": map[string]int{"trakt": 2}}},
+				}),
+			}))
+			host := fakeIndexer(t, newFakeAPI(map[string]http.HandlerFunc{
+				"/api": func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Query().Get("t") == "caps" {
+						w.WriteHeader(test.status)
+						return
+					}
+					replyFeed()(w, r)
+				},
+			}))
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "blacklist.txt"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			app := newTestApp(t, Config{DataDir: dir, MoviesDir: dir, NewsNabHost: host, RequireHealthyIndexer: test.require, HistoryWindow: time.Hour, CleanupMode: "delete"})
+			// Movie 1 is no longer listed and 2 was watched
+			for _, media := range []Media{{Trakt: 1, IMDB: "tt1"}, {Trakt: 2, IMDB: "tt2", OnDisk: true}} {
+				if err := app.Store.Insert(media.Trakt, media); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			app.executeTasks()
+			for _, Trakt := range []int64{1, 2} {
+				err := app.Store.Get(Trakt, &Media{})
+				if removed := err != nil; removed != test.removed {
+					t.Errorf("media %d removed: %v, want %v", Trakt, removed, test.removed)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenStoreWaitsForTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	holder, err := openStore(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		release time.Duration
+		wantErr bool
+	}{
+		{"still locked", 0, true},
+		{"released in time", 50 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.release > 0 {
+				time.AfterFunc(test.release, func() { holder.Close() })
+			}
+			start := time.Now()
+			store, err := openStore(path, 200*time.Millisecond)
+			if test.wantErr {
+				if !errors.Is(err, bolt.ErrTimeout) {
+					t.Errorf("opening a locked database = %v, want a timeout", err)
+				}
+				// bbolt retries the lock every 50ms, so it may give up a retry early
+				if waited := time.Since(start); waited < 100*time.Millisecond {
+					t.Errorf("gave up after %v, want it to wait for the lock", waited)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"slices"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps handler in middlewares, the first one being the outermost.
+func chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.WithFields(log.Fields{
+					"panic": rec,
+					"path":  r.URL.Path,
+				}).Error("handling request")
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware allows the origins in CORS_ALLOWED_ORIGINS, "*" for any, to call the API
+// from a browser. It is read on every request so a reload applies right away.
+func corsMiddleware(appConfig *App) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			allowed := appConfig.Config().CORSAllowedOrigins
+			if origin != "" && (slices.Contains(allowed, "*") || slices.Contains(allowed, origin)) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Add("Vary", "Origin")
+				if r.Method == http.MethodOptions {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	app := newTestApp(t, Config{CORSAllowedOrigins: []string{"https://ui.example.com"}})
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), recoverMiddleware, corsMiddleware(&app))
+
+	tests := []struct {
+		method string
+		origin string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, "https://ui.example.com", http.StatusOK, "https://ui.example.com"},
+		{http.MethodOptions, "https://ui.example.com", http.StatusNoContent, "https://ui.example.com"},
+		{http.MethodGet, "https://evil.example.com", http.StatusOK, ""},
+		{http.MethodGet, "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/medias", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s from %q: status %d, want %d", test.method, test.origin, w.Code, test.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("%s from %q: allowed origin %q, want %q", test.method, test.origin, got, test.allow)
+		}
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), recoverMiddleware)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
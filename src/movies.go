@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/amaumene/momenarr/trakt"
 	"github.com/amaumene/momenarr/trakt/sync"
@@ -8,18 +9,24 @@ import (
 )
 
 func (app App) insertMovieToDB(movie *trakt.Movie) error {
-	if int64(movie.Trakt) > 0 && len(movie.IMDB) > 0 {
+	hasID := len(movie.IMDB) > 0 || (app.Config().AllowMissingIMDB && movie.TMDB > 0)
+	if int64(movie.Trakt) > 0 && hasID {
 		media := Media{
 			Trakt:  int64(movie.Trakt),
 			IMDB:   string(movie.IMDB),
+			TMDB:   int64(movie.TMDB),
 			Title:  movie.Title,
 			Year:   movie.Year,
 			OnDisk: false,
 		}
 		err := app.Store.Insert(int64(movie.Trakt), media)
-		if err != nil && err.Error() != "This Key already exists in this bolthold for this type" {
+		if err != nil && !errors.Is(err, ErrDuplicateKey) {
 			return fmt.Errorf("scanning movie item: %v", err)
 		}
+		if err == nil {
+			app.emit(EventMediaAdded, media, "")
+			app.searchOnAdd(media.Trakt)
+		}
 	}
 	return nil
 }
@@ -29,12 +36,12 @@ func (app App) syncMoviesFromWatchlist() (error, []interface{}) {
 
 	watchListParams := &trakt.ListWatchListParams{
 		ListParams: tokenParams,
-		Type:       "movie",
+		Type:       trakt.TypeMovie,
 	}
 	iterator := sync.WatchList(watchListParams)
 
 	var movies []interface{}
-	for iterator.Next() {
+	for app.timedNext("trakt.WatchList", iterator) {
 		item, err := iterator.Entry()
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -58,12 +65,12 @@ func (app App) syncMoviesFromFavorites() (error, []interface{}) {
 	tokenParams := trakt.ListParams{OAuth: app.TraktToken.AccessToken}
 	params := &trakt.ListFavoritesParams{
 		ListParams: tokenParams,
-		Type:       "movies",
+		Type:       trakt.TypeMovie,
 	}
 	iterator := sync.Favorites(params)
 
 	var movies []interface{}
-	for iterator.Next() {
+	for app.timedNext("trakt.Favorites", iterator) {
 		item, err := iterator.Entry()
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -0,0 +1,116 @@
+package newsnab
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Newznab JSON output (o=json) is the XML feed converted by PHP: XML attributes end up
+// under "@attributes" and a single element isn't wrapped in an array.
+
+type jsonAttributes struct {
+	Attributes map[string]string `json:"@attributes"`
+}
+
+type jsonItem struct {
+	Title       string          `json:"title"`
+	GUID        json.RawMessage `json:"guid"`
+	Link        string          `json:"link"`
+	Comments    string          `json:"comments"`
+	Description string          `json:"description"`
+	PubDate     string          `json:"pubDate"`
+	Enclosure   jsonAttributes  `json:"enclosure"`
+	Attr        json.RawMessage `json:"attr"`
+}
+
+type jsonFeed struct {
+	Channel struct {
+		Title       string          `json:"title"`
+		Link        string          `json:"link"`
+		Description string          `json:"description"`
+		Language    string          `json:"language"`
+		Response    jsonAttributes  `json:"response"`
+		Items       json.RawMessage `json:"item"`
+	} `json:"channel"`
+}
+
+// oneOrMany decodes raw as a list of T, accepting a single T or nothing as well
+func oneOrMany[T any](raw json.RawMessage) ([]T, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var many []T
+	if err := json.Unmarshal(raw, &many); err == nil {
+		return many, nil
+	}
+	var one T
+	if err := json.Unmarshal(raw, &one); err != nil {
+		return nil, err
+	}
+	return []T{one}, nil
+}
+
+func parseGUID(raw json.RawMessage) GUID {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return GUID{Value: value}
+	}
+	var guid struct {
+		Text       string            `json:"text"`
+		Attributes map[string]string `json:"@attributes"`
+	}
+	if err := json.Unmarshal(raw, &guid); err == nil {
+		return GUID{Value: guid.Text, IsPermaLink: guid.Attributes["isPermaLink"]}
+	}
+	return GUID{}
+}
+
+// ParseJSON maps a Newznab JSON response to the same Feed as the XML one
+func ParseJSON(body string) (Feed, error) {
+	var feed Feed
+	var response jsonFeed
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return feed, fmt.Errorf("unmarshalling JSON feed: %v", err)
+	}
+
+	items, err := oneOrMany[jsonItem](response.Channel.Items)
+	if err != nil {
+		return feed, fmt.Errorf("unmarshalling JSON items: %v", err)
+	}
+
+	feed.Channel = Channel{
+		Title:       response.Channel.Title,
+		Link:        response.Channel.Link,
+		Description: response.Channel.Description,
+		Language:    response.Channel.Language,
+		Response: Response{
+			Offset: response.Channel.Response.Attributes["offset"],
+			Total:  response.Channel.Response.Attributes["total"],
+		},
+	}
+	for _, item := range items {
+		attrs, err := oneOrMany[jsonAttributes](item.Attr)
+		if err != nil {
+			return feed, fmt.Errorf("unmarshalling JSON item attributes: %v", err)
+		}
+		var newznabAttr []Attr
+		for _, attr := range attrs {
+			newznabAttr = append(newznabAttr, Attr{Name: attr.Attributes["name"], Value: attr.Attributes["value"]})
+		}
+		feed.Channel.Items = append(feed.Channel.Items, Item{
+			Title:       item.Title,
+			GUID:        parseGUID(item.GUID),
+			Link:        item.Link,
+			Comments:    item.Comments,
+			Description: item.Description,
+			PubDate:     item.PubDate,
+			Enclosure: Enclosure{
+				URL:    item.Enclosure.Attributes["url"],
+				Length: item.Enclosure.Attributes["length"],
+				Type:   item.Enclosure.Attributes["type"],
+			},
+			NewznabAttr: newznabAttr,
+		})
+	}
+	return feed, nil
+}
@@ -0,0 +1,83 @@
+package newsnab
+
+import (
+	"reflect"
+	"testing"
+)
+
+const sampleJSON = `{
+  "@attributes": {"version": "2.0"},
+  "channel": {
+    "title": "indexer",
+    "response": {"@attributes": {"offset": "0", "total": "2"}},
+    "item": [
+      {
+        "title": "Movie.2020.1080p.WEB-DL",
+        "guid": "https://indexer/details/abc",
+        "link": "https://indexer/getnzb/abc",
+        "pubDate": "Mon, 01 Jan 2024 10:00:00 +0000",
+        "enclosure": {"@attributes": {"url": "https://indexer/getnzb/abc", "length": "1234", "type": "application/x-nzb"}},
+        "attr": [
+          {"@attributes": {"name": "category", "value": "2040"}},
+          {"@attributes": {"name": "size", "value": "1234"}}
+        ]
+      },
+      {
+        "title": "Movie.2020.2160p.REMUX",
+        "guid": {"text": "def", "@attributes": {"isPermaLink": "false"}},
+        "link": "https://indexer/getnzb/def",
+        "enclosure": {"@attributes": {"url": "https://indexer/getnzb/def", "length": "5678", "type": "application/x-nzb"}},
+        "attr": {"@attributes": {"name": "category", "value": "2045"}}
+      }
+    ]
+  }
+}`
+
+func TestParseJSON(t *testing.T) {
+	feed, err := ParseJSON(sampleJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Item{
+		{
+			Title:     "Movie.2020.1080p.WEB-DL",
+			GUID:      GUID{Value: "https://indexer/details/abc"},
+			Link:      "https://indexer/getnzb/abc",
+			PubDate:   "Mon, 01 Jan 2024 10:00:00 +0000",
+			Enclosure: Enclosure{URL: "https://indexer/getnzb/abc", Length: "1234", Type: "application/x-nzb"},
+			NewznabAttr: []Attr{
+				{Name: "category", Value: "2040"},
+				{Name: "size", Value: "1234"},
+			},
+		},
+		{
+			Title:       "Movie.2020.2160p.REMUX",
+			GUID:        GUID{Value: "def", IsPermaLink: "false"},
+			Link:        "https://indexer/getnzb/def",
+			Enclosure:   Enclosure{URL: "https://indexer/getnzb/def", Length: "5678", Type: "application/x-nzb"},
+			NewznabAttr: []Attr{{Name: "category", Value: "2045"}},
+		},
+	}
+	if !reflect.DeepEqual(feed.Channel.Items, want) {
+		t.Errorf("items = %+v, want %+v", feed.Channel.Items, want)
+	}
+	if feed.Channel.Response.Total != "2" {
+		t.Errorf("total = %q, want 2", feed.Channel.Response.Total)
+	}
+}
+
+func TestParseJSONSingleItem(t *testing.T) {
+	feed, err := ParseJSON(`{"channel": {"item": {"title": "Only.One", "enclosure": {"@attributes": {"url": "u", "length": "1"}}}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Channel.Items) != 1 || feed.Channel.Items[0].Title != "Only.One" {
+		t.Errorf("items = %+v, want the single item", feed.Channel.Items)
+	}
+}
+
+func TestParseJSONInvalid(t *testing.T) {
+	if _, err := ParseJSON("<rss></rss>"); err == nil {
+		t.Error("parsing XML as JSON succeeded")
+	}
+}
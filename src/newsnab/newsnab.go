@@ -4,40 +4,99 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
+	"strings"
 )
 
-func SearchTVShow(IMDB string, showSeason int64, showEpisode int64, newsNabHost string, newsNabApiKey string) (string, error) {
-	// Construct the URL with the provided arguments
-	url := fmt.Sprintf("https://%s/api?apikey=%s&t=tvsearch&imdbid=%s&season=%d&ep=%d", newsNabHost, newsNabApiKey, IMDB, showSeason, showEpisode)
-	// Make the HTTP GET request
-	resp, err := http.Get(url)
+// ID identifies what to search for. The IMDB ID is used when there is one, TMDB for
+// movies and TVDB for shows otherwise.
+type ID struct {
+	IMDB string
+	TMDB int64
+	TVDB int64
+}
+
+func SearchTVShow(id ID, showSeason int64, showEpisode int64, episodeTitle string, categories []string, newsNabHost string, newsNabApiKey string, jsonOutput bool, maxResponseSize int64) (string, error) {
+	url, err := tvSearchURL(id, showSeason, showEpisode, episodeTitle, categories, newsNabHost, newsNabApiKey, jsonOutput)
 	if err != nil {
-		return "", fmt.Errorf("making request: %v", err)
+		return "", err
 	}
-	defer resp.Body.Close()
+	return get(url, maxResponseSize)
+}
 
-	// Check if the request was successful
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("did not receive a 200 OK status, received %d", resp.StatusCode)
+// tvSearchURL builds the search URL for an episode, by IMDB ID or else TVDB ID.
+func tvSearchURL(id ID, showSeason int64, showEpisode int64, episodeTitle string, categories []string, newsNabHost string, newsNabApiKey string, jsonOutput bool) (string, error) {
+	var idParam string
+	switch {
+	case id.IMDB != "":
+		idParam = "imdbid=" + id.IMDB
+	case id.TVDB > 0:
+		idParam = fmt.Sprintf("tvdbid=%d", id.TVDB)
+	default:
+		return "", fmt.Errorf("no IMDB or TVDB ID")
 	}
+	// Construct the URL with the provided arguments
+	url := fmt.Sprintf("https://%s/api?apikey=%s&t=tvsearch&%s&season=%d&ep=%d", newsNabHost, newsNabApiKey, idParam, showSeason, showEpisode)
+	if episodeTitle != "" {
+		url += "&q=" + neturl.QueryEscape(episodeTitle)
+	}
+	url += categoryParam(categories)
+	if jsonOutput {
+		url += "&o=json"
+	}
+	return url, nil
+}
 
-	// Read the body of the response
-	body, err := io.ReadAll(resp.Body)
+func SearchMovie(id ID, categories []string, newsNabHost string, newsNabApiKey string, jsonOutput bool, maxResponseSize int64) (string, error) {
+	url, err := movieSearchURL(id, categories, newsNabHost, newsNabApiKey, jsonOutput)
 	if err != nil {
-		return "", fmt.Errorf("reading response body: %v", err)
+		return "", err
 	}
-
-	return string(body), nil
+	return get(url, maxResponseSize)
 }
 
-func SearchMovie(IMDB string, newsNabHost string, newsNabApiKey string) (string, error) {
-	if len(IMDB) > 2 {
-		IMDB = IMDB[2:]
-	} else {
+// movieSearchURL builds the search URL for a movie, by IMDB ID or else TMDB ID.
+func movieSearchURL(id ID, categories []string, newsNabHost string, newsNabApiKey string, jsonOutput bool) (string, error) {
+	var idParam string
+	switch {
+	case len(id.IMDB) > 2:
+		idParam = "imdbid=" + id.IMDB[2:]
+	case id.IMDB != "":
 		return "", fmt.Errorf("invalid IMDB ID")
+	case id.TMDB > 0:
+		idParam = fmt.Sprintf("tmdbid=%d", id.TMDB)
+	default:
+		return "", fmt.Errorf("no IMDB or TMDB ID")
 	}
 	// Construct the URL with the provided arguments
-	url := fmt.Sprintf("https://%s/api?apikey=%s&t=movie&imdbid=%s", newsNabHost, newsNabApiKey, IMDB)
+	url := fmt.Sprintf("https://%s/api?apikey=%s&t=movie&%s", newsNabHost, newsNabApiKey, idParam)
+	url += categoryParam(categories)
+	if jsonOutput {
+		url += "&o=json"
+	}
+	return url, nil
+}
+
+// Caps asks the indexer for its capabilities, which is a cheap way to check it is up
+// and accepts the API key.
+func Caps(newsNabHost string, newsNabApiKey string, maxResponseSize int64) error {
+	url := fmt.Sprintf("https://%s/api?apikey=%s&t=caps", newsNabHost, newsNabApiKey)
+	_, err := get(url, maxResponseSize)
+	return err
+}
+
+// categoryParam restricts a search to the given newznab category IDs, or to the
+// indexer's defaults when there are none.
+func categoryParam(categories []string) string {
+	if len(categories) == 0 {
+		return ""
+	}
+	return "&cat=" + neturl.QueryEscape(strings.Join(categories, ","))
+}
+
+// get fetches url and fails when the body is bigger than maxResponseSize bytes,
+// unless maxResponseSize is 0.
+func get(url string, maxResponseSize int64) (string, error) {
 	// Make the HTTP GET request
 	resp, err := http.Get(url)
 	if err != nil {
@@ -51,10 +110,17 @@ func SearchMovie(IMDB string, newsNabHost string, newsNabApiKey string) (string,
 	}
 
 	// Read the body of the response
-	body, err := io.ReadAll(resp.Body)
+	var reader io.Reader = resp.Body
+	if maxResponseSize > 0 {
+		reader = io.LimitReader(resp.Body, maxResponseSize+1)
+	}
+	body, err := io.ReadAll(reader)
 	if err != nil {
 		return "", fmt.Errorf("reading response body: %v", err)
 	}
+	if maxResponseSize > 0 && int64(len(body)) > maxResponseSize {
+		return "", fmt.Errorf("response body bigger than %d bytes", maxResponseSize)
+	}
 
 	return string(body), nil
 }
@@ -0,0 +1,98 @@
+package newsnab
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetLimitsResponseSize(t *testing.T) {
+	body := strings.Repeat("x", 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		max     int64
+		wantErr bool
+	}{
+		{"no limit", "/", 0, false},
+		{"exactly the limit", "/", 10, false},
+		{"under the limit", "/", 100, false},
+		{"over the limit", "/", 9, true},
+		{"error status", "/error", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := get(server.URL+test.path, test.max)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("get = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != body {
+				t.Errorf("get = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestSearchURLsFallBackToOtherIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     func() (string, error)
+		want    string
+		wantErr bool
+	}{
+		{"movie by IMDB ID", func() (string, error) {
+			return movieSearchURL(ID{IMDB: "tt0111161", TMDB: 278}, nil, "indexer", "key", false)
+		}, "https://indexer/api?apikey=key&t=movie&imdbid=0111161", false},
+		{"movie by TMDB ID", func() (string, error) {
+			return movieSearchURL(ID{TMDB: 278}, []string{"2040", "2045"}, "indexer", "key", true)
+		}, "https://indexer/api?apikey=key&t=movie&tmdbid=278&cat=2040%2C2045&o=json", false},
+		{"movie with an invalid IMDB ID", func() (string, error) {
+			return movieSearchURL(ID{IMDB: "tt", TMDB: 278}, nil, "indexer", "key", false)
+		}, "", true},
+		{"movie without ID", func() (string, error) {
+			return movieSearchURL(ID{TVDB: 81189}, nil, "indexer", "key", false)
+		}, "", true},
+		{"episode by IMDB ID", func() (string, error) {
+			return tvSearchURL(ID{IMDB: "tt0903747", TVDB: 81189}, 1, 2, "", nil, "indexer", "key", false)
+		}, "https://indexer/api?apikey=key&t=tvsearch&imdbid=tt0903747&season=1&ep=2", false},
+		{"episode by TVDB ID", func() (string, error) {
+			return tvSearchURL(ID{TVDB: 81189}, 1, 2, "Cat's in the Bag", nil, "indexer", "key", false)
+		}, "https://indexer/api?apikey=key&t=tvsearch&tvdbid=81189&season=1&ep=2&q=Cat%27s+in+the+Bag", false},
+		{"episode without ID", func() (string, error) {
+			return tvSearchURL(ID{TMDB: 1396}, 1, 2, "", nil, "indexer", "key", false)
+		}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.url()
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("URL = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("URL = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
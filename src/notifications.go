@@ -1,20 +1,38 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/amaumene/momenarr/bolthold"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
+func (config Config) downloadDirFor(media Media) string {
+	if media.IsMovie() {
+		return config.MoviesDir
+	}
+	return config.EpisodesDir
+}
+
 func downloadSuccess(notification Success, app App, media Media) error {
 	file, err := findBiggestFile(notification.Dir)
 	if err != nil {
 		return fmt.Errorf("finding biggest file: %v", err)
 	}
+	if nzb, ok := app.tooSmall(media, file); ok {
+		return app.rejectDownload(notification, media, nzb)
+	}
 
-	destPath := filepath.Join(app.Config.DownloadDir, filepath.Base(file))
-	err = os.Rename(file, destPath)
+	destPath := filepath.Join(app.Config().downloadDirFor(media), boundFilename(filepath.Base(file), app.Config().MaxFilenameLength))
+	err = moveFile(file, destPath)
 	if err != nil {
 		return fmt.Errorf("moving file to download directory: %v", err)
 	}
@@ -26,10 +44,60 @@ func downloadSuccess(notification Success, app App, media Media) error {
 
 	media.File = destPath
 	media.OnDisk = true
+	media.DownloadedAt = time.Now()
 	media.DownloadID = "downloaded"
+	media.DownloadStatus = ""
 	if err := app.Store.Update(media.Trakt, &media); err != nil {
 		return fmt.Errorf("update media path/status in database: %v", err)
 	}
+	app.emit(EventDownloadCompleted, media, "")
+	return nil
+}
+
+// tooSmall reports whether file is implausibly small for the release that was downloaded,
+// below COMPLETED_MIN_SIZE_PERCENT of the NZB size, and returns that release.
+func (app App) tooSmall(media Media, file string) (NZB, bool) {
+	var nzb NZB
+	if app.Config().CompletedMinSizePercent <= 0 || len(media.TriedReleases) == 0 {
+		return nzb, false
+	}
+	if err := app.Store.Get(media.TriedReleases[len(media.TriedReleases)-1], &nzb); err != nil || nzb.Length <= 0 {
+		return nzb, false
+	}
+	var size int64
+	if info, err := os.Stat(file); err == nil {
+		size = info.Size()
+	}
+	if size*100 >= nzb.Length*int64(app.Config().CompletedMinSizePercent) {
+		return nzb, false
+	}
+	log.WithFields(log.Fields{
+		"media":    media.Trakt,
+		"title":    nzb.Title,
+		"size":     size,
+		"expected": nzb.Length,
+	}).Warning("Completed file too small, marking release as failed")
+	return nzb, true
+}
+
+func (app App) rejectDownload(notification Success, media Media, nzb NZB) error {
+	nzb.Failed = true
+	nzb.FailedAt = time.Now()
+	if err := app.Store.Update(nzb.GUID, nzb); err != nil {
+		return fmt.Errorf("updating NZB record: %v", err)
+	}
+	if err := os.RemoveAll(notification.Dir); err != nil {
+		return fmt.Errorf("removing download directory: %v", err)
+	}
+	media.DownloadID = ""
+	media.DownloadStatus = ""
+	if err := app.Store.Update(media.Trakt, &media); err != nil {
+		return fmt.Errorf("update media status in database: %v", err)
+	}
+	app.emit(EventDownloadFailed, media, nzb.Title)
+	if _, err := app.downloadNotOnDisk(); err != nil {
+		return fmt.Errorf("downloading on disk: %v", err)
+	}
 	return nil
 }
 
@@ -40,6 +108,7 @@ func downloadFailure(notification Failure, app App) error {
 			return fmt.Errorf("record isn't the correct type! Wanted NZB, got %T", record)
 		}
 		update.Failed = true
+		update.FailedAt = time.Now()
 		return nil
 	})
 	if err != nil {
@@ -54,43 +123,246 @@ func downloadFailure(notification Failure, app App) error {
 		var media Media
 		err = app.Store.Get(nzb.Trakt, &media)
 		if err != nil {
-			return fmt.Errorf("finding media: %s: %v", nzb.Trakt, err)
+			return fmt.Errorf("finding media: %d: %w", nzb.Trakt, err)
 		}
 		media.OnDisk = false
 		media.DownloadID = ""
+		media.DownloadStatus = ""
 		if err := app.Store.Update(nzb.Trakt, &media); err != nil {
 			return fmt.Errorf("update media status in database: %v", err)
 		}
+		app.emit(EventDownloadFailed, media, nzb.Title)
 	}
-	if err = app.downloadNotOnDisk(); err != nil {
+	if _, err = app.downloadNotOnDisk(); err != nil {
 		return fmt.Errorf("downloading on disk: %v", err)
 	}
 	return nil
 }
 
+// claimNotification records key before its notification is processed, inside a single
+// transaction, so of two identical notifications arriving together only one is processed.
+// It returns false for a duplicate received within NOTIFY_DEDUP_WINDOW.
+func claimNotification(key string, app App) (bool, error) {
+	window := app.Config().NotifyDedupWindow
+	if window <= 0 {
+		return true, nil
+	}
+	claimed := false
+	err := app.Store.Bolt().Update(func(tx *bolt.Tx) error {
+		notification := Notification{Key: key, ReceivedAt: time.Now()}
+		err := app.Store.TxInsert(tx, key, notification)
+		if !errors.Is(err, ErrDuplicateKey) {
+			claimed = err == nil
+			return err
+		}
+		var previous Notification
+		if err := app.Store.TxGet(tx, key, &previous); err != nil {
+			return err
+		}
+		if time.Since(previous.ReceivedAt) < window {
+			return nil
+		}
+		// An expired claim that wasn't pruned yet
+		claimed = true
+		return app.Store.TxUpdate(tx, key, notification)
+	})
+	if err != nil {
+		return false, fmt.Errorf("saving notification to database: %v", err)
+	}
+	return claimed, nil
+}
+
+// releaseNotification forgets the claim of a notification that failed to process, so a
+// retry isn't mistaken for a duplicate.
+func releaseNotification(key string, app App) {
+	if app.Config().NotifyDedupWindow <= 0 {
+		return
+	}
+	if err := app.Store.Delete(key, Notification{}); err != nil && !errors.Is(err, ErrNotFound) {
+		log.WithFields(log.Fields{
+			"key": key,
+			"err": err,
+		}).Error("deleting notification from database")
+	}
+}
+
+// pruneNotifications deletes the notifications received longer than NOTIFY_DEDUP_WINDOW
+// ago, which can no longer match a duplicate, and returns how many it deleted.
+func (app App) pruneNotifications() (int, error) {
+	query := bolthold.Where("ReceivedAt").Lt(time.Now().Add(-app.Config().NotifyDedupWindow))
+	count, err := app.Store.Count(&Notification{}, query)
+	if err != nil {
+		return 0, fmt.Errorf("counting notifications: %v", err)
+	}
+	if err := app.Store.DeleteMatching(&Notification{}, query); err != nil {
+		return 0, fmt.Errorf("deleting notifications: %v", err)
+	}
+	return count, nil
+}
+
 func processSuccess(notification Success, app App) error {
+	key := "success:" + notification.Id + ":" + notification.Status
+	claimed, err := claimNotification(key, app)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.WithFields(log.Fields{
+			"id":     notification.Id,
+			"status": notification.Status,
+		}).Info("Ignoring duplicate notification")
+		return nil
+	}
+	if err := handleSuccess(notification, app); err != nil {
+		releaseNotification(key, app)
+		return err
+	}
+	return nil
+}
+
+func handleSuccess(notification Success, app App) error {
 	var media []Media
 	err := app.Store.Find(&media, bolthold.Where("DownloadID").Eq(notification.Id).Limit(1))
 	if err != nil {
 		return fmt.Errorf("finding media: %v", err)
 	}
 	if len(media) > 0 {
+		if !advancesDownloadStatus(media[0].DownloadStatus, notification.Status) {
+			log.WithFields(log.Fields{
+				"id":       notification.Id,
+				"status":   notification.Status,
+				"previous": media[0].DownloadStatus,
+			}).Info("Ignoring out of order notification")
+			return nil
+		}
 		if notification.Status == "" {
 			if err = downloadSuccess(notification, app, media[0]); err != nil {
 				return fmt.Errorf("downloading success: %v", err)
 			}
+			return nil
+		}
+		if err := app.setDownloadStatus(media[0].Trakt, notification.Status); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// downloadStatusRank orders the statuses a download goes through. An empty status
+// means the download is complete and its files are ready to be moved.
+var downloadStatusRank = map[string]int{
+	"QUEUED":          1,
+	"DOWNLOADING":     2,
+	"PROCESSING":      3,
+	"POST-PROCESSING": 4,
+	"SUCCESS":         5,
+	"":                6,
+}
+
+// advancesDownloadStatus reports whether a notification with status moves a download
+// forward from previous. Repeated, regressive and unknown statuses don't.
+func advancesDownloadStatus(previous string, status string) bool {
+	rank, ok := downloadStatusRank[strings.ToUpper(status)]
+	if !ok {
+		return false
+	}
+	if previous == "" {
+		return true
+	}
+	return rank > downloadStatusRank[previous]
+}
+
+func (app App) setDownloadStatus(Trakt int64, status string) error {
+	err := app.Store.UpdateMatching(&Media{}, bolthold.Where("Trakt").Eq(Trakt), func(record interface{}) error {
+		update, ok := record.(*Media)
+		if !ok {
+			return fmt.Errorf("record isn't the correct type! Wanted Media, got %T", record)
+		}
+		update.DownloadStatus = strings.ToUpper(status)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("updating download status in database: %v", err)
+	}
+	return nil
+}
+
 func processFailure(notification Failure, app App) error {
+	key := "failure:" + notification.Message + ":" + notification.Type
+	claimed, err := claimNotification(key, app)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.WithFields(log.Fields{
+			"title": notification.Message,
+			"type":  notification.Type,
+		}).Info("Ignoring duplicate notification")
+		return nil
+	}
 	if err := downloadFailure(notification, app); err != nil {
+		releaseNotification(key, app)
 		return fmt.Errorf("downloading failure: %v", err)
 	}
 	return nil
 }
 
+// boundFilename shortens name to at most max bytes, keeping its extension and never
+// cutting a multibyte character in half. Name is left as is when max is 0, or when it
+// can't be shortened without losing the extension or every character before it.
+func boundFilename(name string, max int) string {
+	if max <= 0 || len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if max <= len(ext) {
+		return name
+	}
+	base := strings.TrimSuffix(name, ext)
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(base[limit]) {
+		limit--
+	}
+	base = strings.TrimRight(base[:limit], " .")
+	if base == "" {
+		return name
+	}
+	return base + ext
+}
+
+// moveFile renames src to dst, or copies it and removes src when they are on different
+// filesystems.
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
 func findBiggestFile(dir string) (string, error) {
 	var biggestFile string
 	var maxSize int64
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestRepeatedNotificationIsIgnored(t *testing.T) {
+	app := newTestApp(t, Config{NotifyDedupWindow: time.Hour})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, DownloadID: "nzo1"}); err != nil {
+		t.Fatal(err)
+	}
+	notification := Success{Id: "nzo1", Status: "DOWNLOADING"}
+	if err := processSuccess(notification, app); err != nil {
+		t.Fatal(err)
+	}
+
+	// Had the repeat been processed again, it would set the status back
+	if err := app.setDownloadStatus(1, "QUEUED"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processSuccess(notification, app); err != nil {
+		t.Fatal(err)
+	}
+	var media Media
+	if err := app.Store.Get(int64(1), &media); err != nil {
+		t.Fatal(err)
+	}
+	if media.DownloadStatus != "QUEUED" {
+		t.Errorf("status = %q, want the repeated notification ignored", media.DownloadStatus)
+	}
+}
+
+func TestFailedNotificationIsProcessedAgain(t *testing.T) {
+	app := newTestApp(t, Config{NotifyDedupWindow: time.Hour})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, DownloadID: "nzo1"}); err != nil {
+		t.Fatal(err)
+	}
+	notification := Success{Id: "nzo1", Dir: filepath.Join(t.TempDir(), "missing")}
+	if err := processSuccess(notification, app); err == nil {
+		t.Fatal("processing a completed download without files succeeded")
+	}
+	claimed, err := claimNotification("success:nzo1:", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Error("a notification that failed to process is treated as a duplicate")
+	}
+}
+
+func TestConcurrentNotificationsAreProcessedOnce(t *testing.T) {
+	app := newTestApp(t, Config{NotifyDedupWindow: time.Hour})
+	var claims atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := claimNotification("success:nzo1:", app)
+			if err != nil {
+				t.Error(err)
+			}
+			if claimed {
+				claims.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := claims.Load(); got != 1 {
+		t.Errorf("%d concurrent notifications claimed, want 1", got)
+	}
+
+	moviesDir := t.TempDir()
+	app = newTestApp(t, Config{NotifyDedupWindow: time.Hour, MoviesDir: moviesDir})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, DownloadID: "nzo1"}); err != nil {
+		t.Fatal(err)
+	}
+	jobDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(jobDir, "movie.mkv"), []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := processSuccess(Success{Id: "nzo1", Dir: jobDir}, app); err != nil {
+				t.Errorf("processing the same notification concurrently: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := os.Stat(filepath.Join(moviesDir, "movie.mkv")); err != nil {
+		t.Errorf("completed file not moved: %v", err)
+	}
+}
+
+func TestPruneNotifications(t *testing.T) {
+	app := newTestApp(t, Config{NotifyDedupWindow: time.Hour})
+	for key, received := range map[string]time.Time{
+		"old":    time.Now().Add(-2 * time.Hour),
+		"recent": time.Now().Add(-time.Minute),
+	} {
+		if err := app.Store.Insert(key, Notification{Key: key, ReceivedAt: received}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruned, err := app.pruneNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("pruned %d notifications, want 1", pruned)
+	}
+	if err := app.Store.Get("recent", &Notification{}); err != nil {
+		t.Errorf("recent notification pruned: %v", err)
+	}
+	if claimed, err := claimNotification("old", app); err != nil || !claimed {
+		t.Errorf("claiming a pruned notification = %v, %v, want claimed", claimed, err)
+	}
+}
+
+func TestOutOfOrderStatusesOnlyAdvance(t *testing.T) {
+	moviesDir := t.TempDir()
+	app := newTestApp(t, Config{MoviesDir: moviesDir})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1, DownloadID: "nzo1"}); err != nil {
+		t.Fatal(err)
+	}
+	jobDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(jobDir, "movie.mkv"), []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		status string
+		want   string
+	}{
+		{"QUEUED", "QUEUED"},
+		{"PROCESSING", "PROCESSING"},
+		{"DOWNLOADING", "PROCESSING"},
+		{"POST-PROCESSING", "POST-PROCESSING"},
+		{"QUEUED", "POST-PROCESSING"},
+		{"UNKNOWN", "POST-PROCESSING"},
+	} {
+		if err := processSuccess(Success{Id: "nzo1", Status: step.status, Dir: jobDir}, app); err != nil {
+			t.Fatal(err)
+		}
+		var media Media
+		if err := app.Store.Get(int64(1), &media); err != nil {
+			t.Fatal(err)
+		}
+		if media.DownloadStatus != step.want {
+			t.Errorf("after %s: status = %q, want %q", step.status, media.DownloadStatus, step.want)
+		}
+	}
+
+	if err := processSuccess(Success{Id: "nzo1", Dir: jobDir}, app); err != nil {
+		t.Fatal(err)
+	}
+	var media Media
+	if err := app.Store.Get(int64(1), &media); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(moviesDir, "movie.mkv")
+	if !media.OnDisk || media.File != want || media.DownloadStatus != "" {
+		t.Errorf("completed media = on disk %v, file %q, status %q, want on disk in %q", media.OnDisk, media.File, media.DownloadStatus, want)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("completed file not moved: %v", err)
+	}
+}
+
+func TestBoundFilename(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".mkv"
+	tests := []struct {
+		name string
+		max  int
+		want string
+	}{
+		{"short.mkv", 255, "short.mkv"},
+		{"abcdefgh.mkv", 0, "abcdefgh.mkv"},
+		{"abcdefgh.mkv", 8, "abcd.mkv"},
+		// Keeping 4 bytes of the name would split the second é in half
+		{"aéééé.mkv", 8, "aé.mkv"},
+		{"title. .rest.mkv", 11, "title.mkv"},
+		// Nothing but the extension or part of it would be left
+		{"   .....  x.mkv", 6, "   .....  x.mkv"},
+		{"abcdef.mkv", 4, "abcdef.mkv"},
+	}
+	for _, test := range tests {
+		if got := boundFilename(test.name, test.max); got != test.want {
+			t.Errorf("boundFilename(%q, %d) = %q, want %q", test.name, test.max, got, test.want)
+		}
+	}
+
+	bounded := boundFilename(long, 255)
+	if len(bounded) > 255 || !utf8.ValidString(bounded) || !strings.HasSuffix(bounded, ".mkv") {
+		t.Errorf("boundFilename of a long unicode name = %q (%d bytes), want a valid name of at most 255 bytes ending in .mkv", bounded, len(bounded))
+	}
+}
+
+func TestDownloadDirFor(t *testing.T) {
+	config := Config{MoviesDir: "/movies", EpisodesDir: "/episodes"}
+	if dir := config.downloadDirFor(Media{Trakt: 1}); dir != "/movies" {
+		t.Errorf("movie directory = %q, want /movies", dir)
+	}
+	if dir := config.downloadDirFor(Media{Trakt: 2, Season: 1, Number: 1}); dir != "/episodes" {
+		t.Errorf("episode directory = %q, want /episodes", dir)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "movie.mkv")
+	dst := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(src, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+	if content, err := os.ReadFile(dst); err != nil || string(content) != "movie" {
+		t.Errorf("destination = %q, %v, want the moved content", content, err)
+	}
+}
+
+func TestTooSmallComparesWithTheRelease(t *testing.T) {
+	app := newTestApp(t, Config{CompletedMinSizePercent: 50})
+	if err := app.Store.Insert("nzb", NZB{GUID: "nzb", Trakt: 1, Length: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	media := Media{Trakt: 1, TriedReleases: []string{"nzb"}}
+	dir := t.TempDir()
+	tests := []struct {
+		size     int
+		tooSmall bool
+	}{
+		{0, true},
+		{499, true},
+		{500, false},
+		{1000, false},
+	}
+	for _, test := range tests {
+		file := filepath.Join(dir, "movie.mkv")
+		if err := os.WriteFile(file, make([]byte, test.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, got := app.tooSmall(media, file); got != test.tooSmall {
+			t.Errorf("tooSmall with %d bytes = %v, want %v", test.size, got, test.tooSmall)
+		}
+	}
+	if _, got := app.tooSmall(media, filepath.Join(dir, "missing.mkv")); !got {
+		t.Error("a missing file is not too small")
+	}
+	if _, got := app.tooSmall(Media{Trakt: 1}, filepath.Join(dir, "missing.mkv")); got {
+		t.Error("too small without a tried release")
+	}
+}
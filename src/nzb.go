@@ -3,71 +3,268 @@ package main
 import (
 	"bufio"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/amaumene/momenarr/bolthold"
 	"github.com/amaumene/momenarr/newsnab"
+	log "github.com/sirupsen/logrus"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// narrow leaves out the releases already downloaded for a media when
+// AVOID_RETRIED_RELEASES is set, and keeps only those of edition when it is set.
+func (app App) narrow(query *bolthold.Query, media Media, edition *regexp.Regexp) *bolthold.Query {
+	if edition != nil {
+		query = query.And("Title").RegExp(edition)
+	}
+	if !app.Config().AvoidRetriedReleases || len(media.TriedReleases) == 0 {
+		return query
+	}
+	keys := make([]interface{}, len(media.TriedReleases))
+	for i, release := range media.TriedReleases {
+		keys[i] = release
+	}
+	return query.And(bolthold.Key).Not().In(keys...)
+}
+
 func (app App) getNzbFromDB(Trakt int64) (NZB, error) {
+	var media Media
+	if err := app.Store.Get(Trakt, &media); err != nil {
+		return NZB{}, fmt.Errorf("getting media from database: %w", err)
+	}
+	// The preferred edition wins over quality, other editions are only picked when it isn't available
+	if edition := app.Config().editionFor(media); edition != "" {
+		nzb, err := app.pickNZB(media, editionPatterns[edition])
+		if err != nil {
+			return NZB{}, err
+		}
+		if nzb != nil {
+			return *nzb, nil
+		}
+	}
+	nzb, err := app.pickNZB(media, nil)
+	if err != nil {
+		return NZB{}, err
+	}
+	if nzb != nil {
+		return *nzb, nil
+	}
+	return NZB{}, fmt.Errorf("no NZB found for %d", Trakt)
+}
+
+func (app App) pickNZB(media Media, edition *regexp.Regexp) (*NZB, error) {
+	Trakt := media.Trakt
 	var nzb []NZB
-	err := app.Store.Find(&nzb, bolthold.Where("Trakt").Eq(Trakt).And("Title").
+	err := app.Store.Find(&nzb, app.narrow(bolthold.Where("Trakt").Eq(Trakt).And("Title").
 		RegExp(regexp.MustCompile("(?i)remux")).
-		And("Failed").Eq(false).
+		And("Failed").Eq(false), media, edition).
 		SortBy("Length").Reverse().Limit(1).Index("Trakt"))
 	if err != nil {
-		return NZB{}, fmt.Errorf("request NZB remux from database: %v", err)
+		return nil, fmt.Errorf("request NZB remux from database: %v", err)
+	}
+	if len(nzb) == 0 && app.Config().UntaggedRemuxMinSize > 0 {
+		// Big enough releases without a source tag are most likely remuxes
+		err = app.Store.Find(&nzb, app.narrow(bolthold.Where("Trakt").Eq(Trakt).And("Title").
+			Not().RegExp(regexp.MustCompile("(?i)web-dl")).
+			And("Length").Ge(app.Config().UntaggedRemuxMinSize).
+			And("Failed").Eq(false), media, edition).
+			SortBy("Length").Reverse().Limit(1).Index("Trakt"))
+		if err != nil {
+			return nil, fmt.Errorf("request NZB untagged remux from database: %v", err)
+		}
 	}
 	if len(nzb) == 0 {
-		err = app.Store.Find(&nzb, bolthold.Where("Trakt").Eq(Trakt).And("Title").
+		err = app.Store.Find(&nzb, app.narrow(bolthold.Where("Trakt").Eq(Trakt).And("Title").
 			RegExp(regexp.MustCompile("(?i)web-dl")).
-			And("Failed").Eq(false).
+			And("Failed").Eq(false), media, edition).
 			SortBy("Length").Reverse().Limit(1).Index("Trakt"))
 		if err != nil {
-			return NZB{}, fmt.Errorf("request NZB web-dl from database: %v", err)
+			return nil, fmt.Errorf("request NZB web-dl from database: %v", err)
 		}
 	}
 	if len(nzb) == 0 {
-		err = app.Store.Find(&nzb, bolthold.Where("Trakt").Eq(Trakt).
-			And("Failed").Eq(false).
+		err = app.Store.Find(&nzb, app.narrow(bolthold.Where("Trakt").Eq(Trakt).
+			And("Failed").Eq(false), media, edition).
 			SortBy("Length").Reverse().Limit(1).Index("Trakt"))
 		if err != nil {
-			return NZB{}, fmt.Errorf("request NZB no filters from database: %v", err)
+			return nil, fmt.Errorf("request NZB no filters from database: %v", err)
 		}
 	}
 	if len(nzb) > 0 {
-		return nzb[0], nil
+		return &nzb[0], nil
 	}
-	return NZB{}, fmt.Errorf("no NZB found for %d", Trakt)
+	return nil, nil
+}
+
+func (app App) isAllowedNZBHost(link string) (bool, error) {
+	if len(app.Config().NZBAllowedHosts) == 0 {
+		return true, nil
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false, fmt.Errorf("parsing NZB link: %v", err)
+	}
+	for _, host := range app.Config().NZBAllowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (app App) searchNZB(media Media) (newsnab.Feed, error) {
+	app.InFlight.Searches.Add(1)
+	defer app.InFlight.Searches.Add(-1)
+	if app.Config().NewsNabJSON && !app.skipJSON() {
+		feed, err := app.searchNZBFormat(media, true)
+		if err == nil {
+			return feed, nil
+		}
+		app.JSONFailures.Add(1)
+		log.WithFields(log.Fields{
+			"err":   err,
+			"media": media.Trakt,
+		}).Warning("JSON search failed, falling back to XML")
+	}
+	return app.searchNZBFormat(media, false)
+}
+
+// skipJSON reports whether JSON searches failed NEWSNAB_JSON_MAX_FAILURES times already
+// in this run, in which case the rest of the run searches in XML straight away.
+func (app App) skipJSON() bool {
+	max := app.Config().NewsNabJSONMaxFailures
+	return max > 0 && app.JSONFailures.Load() >= int64(max)
+}
+
+// isHTML tells apart the error and maintenance pages some indexers serve in place of
+// a feed.
+func isHTML(response string) bool {
+	start := strings.ToLower(strings.TrimSpace(response))
+	if len(start) > 512 {
+		start = start[:512]
+	}
+	return strings.HasPrefix(start, "<!doctype html") || strings.HasPrefix(start, "<html") || strings.Contains(start, "<head>")
+}
+
+func parseFeed(response string, jsonOutput bool) (newsnab.Feed, error) {
+	if isHTML(response) {
+		log.WithFields(log.Fields{
+			"body": truncate(response, 200),
+		}).Warning("Indexer answered with an HTML page, treating it as no results")
+		return newsnab.Feed{}, nil
+	}
+	if jsonOutput {
+		return newsnab.ParseJSON(response)
+	}
 	var feed newsnab.Feed
-	if media.Number > 0 && media.Season > 0 {
-		xmlResponse, err := newsnab.SearchTVShow(media.IMDB, media.Season, media.Number, app.Config.NewsNabHost, app.Config.NewsNabApiKey)
+	if err := xml.Unmarshal([]byte(response), &feed); err != nil {
+		return feed, fmt.Errorf("unmarshalling XML feed: %v", err)
+	}
+	return feed, nil
+}
+
+func (media Media) searchID() newsnab.ID {
+	return newsnab.ID{IMDB: media.IMDB, TMDB: media.TMDB, TVDB: media.TVDB}
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
+func (app App) searchNZBFormat(media Media, jsonOutput bool) (newsnab.Feed, error) {
+	var feed newsnab.Feed
+	if !media.IsMovie() {
+		var episodeTitle string
+		if app.Config().EpisodeTitleInSearch {
+			episodeTitle = media.Title
+		}
+		var response string
+		err := app.timeCall("newsnab.SearchTVShow", func() error {
+			var err error
+			response, err = newsnab.SearchTVShow(media.searchID(), media.Season, media.Number, episodeTitle, app.Config().NewsNabTVCategories, app.Config().NewsNabHost, app.Config().NewsNabApiKey, jsonOutput, app.Config().NewsNabMaxResponseSize)
+			return err
+		})
 		if err != nil {
 			return feed, fmt.Errorf("searching NZB for episode: %v", err)
 		}
-		err = xml.Unmarshal([]byte(xmlResponse), &feed)
+		feed, err = parseFeed(response, jsonOutput)
 		if err != nil {
-			return feed, fmt.Errorf("unmarshalling XML NZB episode: %v", err)
+			return feed, fmt.Errorf("parsing NZB episode: %v", err)
 		}
 	} else {
-		xmlResponse, err := newsnab.SearchMovie(media.IMDB, app.Config.NewsNabHost, app.Config.NewsNabApiKey)
+		var response string
+		err := app.timeCall("newsnab.SearchMovie", func() error {
+			var err error
+			response, err = newsnab.SearchMovie(media.searchID(), app.Config().NewsNabMovieCategories, app.Config().NewsNabHost, app.Config().NewsNabApiKey, jsonOutput, app.Config().NewsNabMaxResponseSize)
+			return err
+		})
 		if err != nil {
 			return feed, fmt.Errorf("searching NZB for movie: %v", err)
 		}
-		err = xml.Unmarshal([]byte(xmlResponse), &feed)
+		feed, err = parseFeed(response, jsonOutput)
 		if err != nil {
-			return feed, fmt.Errorf("unmarshalling XML NZB movie: %v", err)
+			return feed, fmt.Errorf("parsing NZB movie: %v", err)
 		}
 	}
 	return feed, nil
 }
 
+func (app App) indexerHealthy() bool {
+	err := app.timeCall("newsnab.Caps", func() error {
+		return newsnab.Caps(app.Config().NewsNabHost, app.Config().NewsNabApiKey, app.Config().NewsNabMaxResponseSize)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warning("Indexer health check failed")
+		return false
+	}
+	return true
+}
+
+// blacklistCache keeps the last blacklist read, so it is only read again once the file
+// changes instead of for every media searched.
+var blacklistCache struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	words   []string
+}
+
+func loadBlacklist(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening blacklist file: %v", err)
+	}
+	blacklistCache.Lock()
+	defer blacklistCache.Unlock()
+	if blacklistCache.path == path && blacklistCache.modTime.Equal(info.ModTime()) && blacklistCache.size == info.Size() {
+		return blacklistCache.words, nil
+	}
+	words, err := readBlacklist(path)
+	if err != nil {
+		return nil, err
+	}
+	if blacklistCache.path != "" {
+		log.WithFields(log.Fields{"path": path, "words": len(words)}).Info("Blacklist changed, reloaded")
+	}
+	blacklistCache.path = path
+	blacklistCache.modTime = info.ModTime()
+	blacklistCache.size = info.Size()
+	blacklistCache.words = words
+	return words, nil
+}
+
 func readBlacklist(path string) ([]string, error) {
 	var blacklist []string
 	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
@@ -89,43 +286,161 @@ func readBlacklist(path string) ([]string, error) {
 	return blacklist, nil
 }
 
-func (app App) insertNZBItems(media Media, items []newsnab.Item) error {
+const reasonHostNotAllowed = "link host not in NZB_ALLOWED_HOSTS"
+
+func (app App) nzbRejectReason(item newsnab.Item, blacklist []string) (string, error) {
+	for _, word := range blacklist {
+		if strings.Contains(strings.ToLower(item.Title), strings.ToLower(word)) {
+			return fmt.Sprintf("title contains blacklisted word %q", word), nil
+		}
+	}
+	for _, attr := range item.NewznabAttr {
+		if attr.Name != "category" {
+			continue
+		}
+		for _, excluded := range app.Config().NewsNabExcludedCategories {
+			if attr.Value == excluded {
+				return fmt.Sprintf("category %s is in NEWSNAB_EXCLUDE_CATEGORIES", excluded), nil
+			}
+		}
+	}
+	if app.Config().MinReleaseAge > 0 {
+		// Releases without a readable date are accepted rather than held back forever.
+		if published, err := time.Parse(time.RFC1123Z, item.PubDate); err == nil && time.Since(published) < app.Config().MinReleaseAge {
+			return fmt.Sprintf("published %s ago, less than MIN_RELEASE_AGE", time.Since(published).Round(time.Minute)), nil
+		}
+	}
+	allowed, err := app.isAllowedNZBHost(item.Enclosure.URL)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return reasonHostNotAllowed, nil
+	}
+	return "", nil
+}
+
+func (app App) nzbTier(title string, length int64) string {
+	switch {
+	case regexp.MustCompile("(?i)remux").MatchString(title):
+		return "remux"
+	case regexp.MustCompile("(?i)web-dl").MatchString(title):
+		return "web-dl"
+	case app.Config().UntaggedRemuxMinSize > 0 && length >= app.Config().UntaggedRemuxMinSize:
+		return "remux"
+	default:
+		return "other"
+	}
+}
+
+// insertNZBItems stores the items that pass the filters and returns how many were new.
+func (app App) insertNZBItems(media Media, items []newsnab.Item) (int, error) {
+	blacklist, err := loadBlacklist(app.Config().DataDir + "/blacklist.txt")
+	if err != nil {
+		return 0, fmt.Errorf("reading blacklist: %v", err)
+	}
+
+	inserted := 0
 	for _, item := range items {
-		blacklist, err := readBlacklist(app.Config.DataDir + "/blacklist.txt")
+		reason, err := app.nzbRejectReason(item, blacklist)
 		if err != nil {
-			return fmt.Errorf("reading blacklist: %v", err)
+			return inserted, err
 		}
-
-		shouldInsert := true
-		for _, word := range blacklist {
-			if strings.Contains(strings.ToLower(item.Title), strings.ToLower(word)) {
-				shouldInsert = false
-				break
-			}
+		if reason == reasonHostNotAllowed {
+			log.WithFields(log.Fields{
+				"title": item.Title,
+				"link":  item.Enclosure.URL,
+			}).Warning("Ignoring NZB link to a host not in NZB_ALLOWED_HOSTS")
 		}
 
-		if shouldInsert {
+		if reason == "" {
 			length, err := strconv.ParseInt(item.Enclosure.Length, 10, 64)
 			if err != nil {
-				return fmt.Errorf("converting NZB media length to int64: %v", err)
+				return inserted, fmt.Errorf("converting NZB media length to int64: %v", err)
 			}
 
+			guid := strings.TrimPrefix(item.GUID.Value, "https://v2.nzbs.in/releases/")
 			nzb := NZB{
+				GUID:   guid,
 				Trakt:  media.Trakt,
 				Link:   item.Enclosure.URL,
 				Length: length,
 				Title:  item.Title,
 			}
-			err = app.Store.Insert(strings.TrimPrefix(item.GUID.Value, "https://v2.nzbs.in/releases/"), nzb)
-			if err != nil && err.Error() != "This Key already exists in this bolthold for this type" {
-				return fmt.Errorf("inserting NZB media into database: %v", err)
+			err = app.Store.Insert(guid, nzb)
+			if err != nil && !errors.Is(err, ErrDuplicateKey) {
+				return inserted, fmt.Errorf("inserting NZB media into database: %v", err)
+			}
+			if err == nil {
+				inserted++
 			}
 		}
 	}
+	return inserted, nil
+}
+
+func (app App) shouldSkipSearch(media Media) bool {
+	if app.Config().SearchBackoff <= 0 || media.EmptySearches == 0 {
+		return false
+	}
+	backoff := app.Config().SearchBackoff
+	for i := 1; i < media.EmptySearches && backoff < app.Config().SearchBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > app.Config().SearchBackoffMax {
+		backoff = app.Config().SearchBackoffMax
+	}
+	return time.Since(media.LastSearchAt) < backoff
+}
+
+func (config Config) searchInterval(media Media) time.Duration {
+	if media.IsMovie() {
+		return config.MovieSearchInterval
+	}
+	return config.EpisodeSearchInterval
+}
+
+// searchDue reports whether media was searched longer than its search interval ago. A media
+// without an interval is searched on every sync run, but not by the search loop between syncs.
+func (config Config) searchDue(media Media, betweenSyncs bool) bool {
+	interval := config.searchInterval(media)
+	if interval <= 0 {
+		return !betweenSyncs
+	}
+	return time.Since(media.LastSearchAt) >= interval
+}
+
+func (config Config) searchLoopInterval() time.Duration {
+	interval := config.MovieSearchInterval
+	if interval <= 0 || (config.EpisodeSearchInterval > 0 && config.EpisodeSearchInterval < interval) {
+		interval = config.EpisodeSearchInterval
+	}
+	return interval
+}
+
+// recordSearch notes when a media was searched and whether the search found any new
+// release passing the filters, which decides its backoff.
+func (app App) recordSearch(Trakt int64, results int) error {
+	err := app.Store.UpdateMatching(&Media{}, bolthold.Where("Trakt").Eq(Trakt), func(record interface{}) error {
+		update, ok := record.(*Media)
+		if !ok {
+			return fmt.Errorf("record isn't the correct type! Wanted Media, got %T", record)
+		}
+		update.LastSearchAt = time.Now()
+		if results == 0 {
+			update.EmptySearches++
+		} else {
+			update.EmptySearches = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("recording search in database: %v", err)
+	}
 	return nil
 }
 
-func (app App) populateNZB() error {
+func (app App) populateNZB(betweenSyncs bool) error {
 	var medias []Media
 	err := app.Store.Find(&medias, bolthold.Where("OnDisk").Eq(false).SortBy("Trakt"))
 	if err != nil {
@@ -133,16 +448,234 @@ func (app App) populateNZB() error {
 	}
 
 	for _, media := range medias {
+		if media.DownloadID != "" {
+			// Already sent to SABnzbd, a failure notification clears DownloadID and makes it searchable again
+			continue
+		}
+		if app.shouldSkipSearch(media) {
+			log.WithFields(log.Fields{
+				"media":          media.Trakt,
+				"title":          media.Title,
+				"empty_searches": media.EmptySearches,
+			}).Debug("Skipping search, previous searches found nothing")
+			continue
+		}
+		if !app.Config().searchDue(media, betweenSyncs) {
+			log.WithFields(log.Fields{
+				"media":          media.Trakt,
+				"title":          media.Title,
+				"last_search_at": media.LastSearchAt,
+			}).Debug("Skipping search, searched recently")
+			continue
+		}
 		feed, err := app.searchNZB(media)
 		if err != nil {
 			return err
 		}
-		if len(feed.Channel.Items) > 0 {
-			err := app.insertNZBItems(media, feed.Channel.Items)
-			if err != nil {
-				return err
-			}
+		inserted, err := app.insertNZBItems(media, feed.Channel.Items)
+		if err != nil {
+			return err
+		}
+		if err := app.recordSearch(media.Trakt, inserted); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+type SearchOutcome struct {
+	Trakt      int64  `json:"trakt"`
+	Title      string `json:"title"`
+	Found      int    `json:"found"`
+	Release    *NZB   `json:"release,omitempty"`
+	DownloadID string `json:"download_id,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// searchOne runs the search and download steps of a run for a single media.
+func (app App) searchOne(media Media) (SearchOutcome, error) {
+	outcome := SearchOutcome{Trakt: media.Trakt, Title: media.Title}
+	if media.OnDisk {
+		outcome.Reason = "already on disk"
+		return outcome, nil
+	}
+	if media.DownloadID != "" {
+		outcome.DownloadID = media.DownloadID
+		outcome.Reason = "already downloading"
+		return outcome, nil
+	}
+
+	feed, err := app.searchNZB(media)
+	if err != nil {
+		return outcome, err
+	}
+	outcome.Found = len(feed.Channel.Items)
+	inserted, err := app.insertNZBItems(media, feed.Channel.Items)
+	if err != nil {
+		return outcome, err
+	}
+	if err := app.recordSearch(media.Trakt, inserted); err != nil {
+		return outcome, err
+	}
+
+	nzb, err := app.getNzbFromDB(media.Trakt)
+	if err != nil {
+		outcome.Reason = "no acceptable release: " + err.Error()
+		return outcome, nil
+	}
+	outcome.Release = &nzb
+	if err := app.createDownload(media.Trakt, nzb); err != nil {
+		return outcome, err
+	}
+	if err := app.Store.Get(media.Trakt, &media); err != nil {
+		return outcome, fmt.Errorf("getting media from database: %v", err)
+	}
+	outcome.DownloadID = media.DownloadID
+	return outcome, nil
+}
+
+// searchAdded searches and downloads the given newly added medias, skipping those a run
+// already searched in the meantime.
+func (app App) searchAdded(ids []int64) {
+	for _, Trakt := range ids {
+		var media Media
+		if err := app.Store.Get(Trakt, &media); err != nil {
+			log.WithFields(log.Fields{"media": Trakt, "err": err}).Error("getting added media")
+			continue
+		}
+		if !media.LastSearchAt.IsZero() {
+			continue
+		}
+		outcome, err := app.searchOne(media)
+		if err != nil {
+			log.WithFields(log.Fields{"media": Trakt, "err": err}).Error("searching added media")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"media":       Trakt,
+			"found":       outcome.Found,
+			"download_id": outcome.DownloadID,
+			"reason":      outcome.Reason,
+		}).Info("Searched added media")
+	}
+}
+
+// searchOnAdd searches the given newly added medias in the background when SEARCH_ON_ADD
+// is set, instead of waiting for the next run.
+func (app App) searchOnAdd(ids ...int64) {
+	if !app.Config().SearchOnAdd || len(ids) == 0 {
+		return
+	}
+	if !app.startTask("searching added media", func() { app.searchAdded(ids) }) {
+		log.WithFields(log.Fields{"medias": len(ids)}).Info("Tasks already running, added medias will be searched on the next run")
+	}
+}
+
+type Candidate struct {
+	Title    string `json:"title"`
+	Link     string `json:"link"`
+	Length   int64  `json:"length"`
+	Tier     string `json:"tier"`
+	Edition  string `json:"edition,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+var tierRank = map[string]int{"remux": 0, "web-dl": 1, "other": 2}
+
+func (app App) previewSearch(media Media) ([]Candidate, error) {
+	feed, err := app.searchNZB(media)
+	if err != nil {
+		return nil, err
+	}
+	blacklist, err := loadBlacklist(app.Config().DataDir + "/blacklist.txt")
+	if err != nil {
+		return nil, fmt.Errorf("reading blacklist: %v", err)
+	}
+
+	candidates := make([]Candidate, 0, len(feed.Channel.Items))
+	for _, item := range feed.Channel.Items {
+		reason, err := app.nzbRejectReason(item, blacklist)
+		if err != nil {
+			return nil, err
+		}
+		guid := strings.TrimPrefix(item.GUID.Value, "https://v2.nzbs.in/releases/")
+		if reason == "" && app.Config().AvoidRetriedReleases && slices.Contains(media.TriedReleases, guid) {
+			reason = "already downloaded, AVOID_RETRIED_RELEASES is set"
+		}
+		length, err := strconv.ParseInt(item.Enclosure.Length, 10, 64)
+		if err != nil && reason == "" {
+			reason = "invalid length"
+		}
+		candidates = append(candidates, Candidate{
+			Title:    item.Title,
+			Link:     item.Enclosure.URL,
+			Length:   length,
+			Tier:     app.nzbTier(item.Title, length),
+			Edition:  parseEdition(item.Title),
+			Accepted: reason == "",
+			Reason:   reason,
+		})
+	}
+	// Same order getNzbFromDB picks from: accepted first, then the preferred edition, then remux, web-dl,
+	// the rest, biggest first
+	edition := app.Config().editionFor(media)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Accepted != b.Accepted {
+			return a.Accepted
+		}
+		if edition != "" && (a.Edition == edition) != (b.Edition == edition) {
+			return a.Edition == edition
+		}
+		if tierRank[a.Tier] != tierRank[b.Tier] {
+			return tierRank[a.Tier] < tierRank[b.Tier]
+		}
+		return a.Length > b.Length
+	})
+	return candidates, nil
+}
+
+// purgeFailedNZBs deletes the NZBs that failed more than olderThan ago, including those
+// that failed before the failure time was recorded, and returns how many it deleted.
+func (app App) purgeFailedNZBs(olderThan time.Duration) (int, error) {
+	query := bolthold.Where("Failed").Eq(true).And("FailedAt").Lt(time.Now().Add(-olderThan))
+	count, err := app.Store.Count(&NZB{}, query)
+	if err != nil {
+		return 0, fmt.Errorf("counting failed NZBs: %v", err)
+	}
+	if err := app.Store.DeleteMatching(&NZB{}, query); err != nil {
+		return 0, fmt.Errorf("deleting failed NZBs: %v", err)
+	}
+	return count, nil
+}
+
+func (app App) findFailedNZBs() ([]NZB, error) {
+	nzbs := []NZB{}
+	if err := app.Store.Find(&nzbs, bolthold.Where("Failed").Eq(true).SortBy("Trakt")); err != nil {
+		return nil, fmt.Errorf("finding failed NZBs: %v", err)
+	}
+	return nzbs, nil
+}
+
+// clearFailedFlags marks the failed NZBs of Trakt, or of every media when Trakt is 0, as usable again
+func (app App) clearFailedFlags(Trakt int64) (int, error) {
+	query := bolthold.Where("Failed").Eq(true)
+	if Trakt > 0 {
+		query = query.And("Trakt").Eq(Trakt)
+	}
+	cleared := 0
+	err := app.Store.UpdateMatching(&NZB{}, query, func(record interface{}) error {
+		update, ok := record.(*NZB)
+		if !ok {
+			return fmt.Errorf("record isn't the correct type! Wanted NZB, got %T", record)
+		}
+		update.Failed = false
+		cleared++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("clearing failed NZBs: %v", err)
+	}
+	return cleared, nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amaumene/momenarr/newsnab"
+	"github.com/amaumene/momenarr/trakt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestShouldSkipSearchBacksOff(t *testing.T) {
+	app := newTestApp(t, Config{SearchBackoff: time.Hour, SearchBackoffMax: 8 * time.Hour})
+	now := time.Now()
+	tests := []struct {
+		empty int
+		ago   time.Duration
+		want  bool
+	}{
+		{0, time.Minute, false},
+		{1, 30 * time.Minute, true},
+		{1, 2 * time.Hour, false},
+		// The wait doubles after every empty search: 4h after three of them
+		{3, 3 * time.Hour, true},
+		{3, 5 * time.Hour, false},
+		// and stops at SEARCH_BACKOFF_MAX
+		{10, 9 * time.Hour, false},
+	}
+	for _, test := range tests {
+		media := Media{EmptySearches: test.empty, LastSearchAt: now.Add(-test.ago)}
+		if got := app.shouldSkipSearch(media); got != test.want {
+			t.Errorf("%d empty searches, last %s ago: skip = %v, want %v", test.empty, test.ago, got, test.want)
+		}
+	}
+}
+
+func TestRejectedResultsCountAsEmptySearch(t *testing.T) {
+	dataDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, "blacklist.txt"), []byte("cam\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, Config{DataDir: dataDir, SearchBackoff: time.Hour, SearchBackoffMax: time.Hour})
+	media := Media{Trakt: 1, IMDB: "tt1"}
+	if err := app.Store.Insert(media.Trakt, media); err != nil {
+		t.Fatal(err)
+	}
+	item := func(title string) newsnab.Item {
+		return newsnab.Item{
+			Title:     title,
+			GUID:      newsnab.GUID{Value: title},
+			Enclosure: newsnab.Enclosure{URL: "https://indexer/" + title, Length: "100"},
+		}
+	}
+
+	search := func(items ...newsnab.Item) Media {
+		t.Helper()
+		inserted, err := app.insertNZBItems(media, items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := app.recordSearch(media.Trakt, inserted); err != nil {
+			t.Fatal(err)
+		}
+		var stored Media
+		if err := app.Store.Get(media.Trakt, &stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	stored := search(item("Movie.2020.CAM"), item("Movie.2020.HDCAM"))
+	if stored.EmptySearches != 1 || !app.shouldSkipSearch(stored) {
+		t.Errorf("all results rejected: %d empty searches, skip %v, want 1 and skipped", stored.EmptySearches, app.shouldSkipSearch(stored))
+	}
+	stored = search(item("Movie.2020.CAM"), item("Movie.2020.1080p.WEB-DL"))
+	if stored.EmptySearches != 0 {
+		t.Errorf("a result accepted: %d empty searches, want 0", stored.EmptySearches)
+	}
+	stored = search(item("Movie.2020.1080p.WEB-DL"))
+	if stored.EmptySearches != 1 {
+		t.Errorf("only a release already stored: %d empty searches, want 1", stored.EmptySearches)
+	}
+}
+
+func TestPurgeFailedNZBs(t *testing.T) {
+	app := newTestApp(t, Config{})
+	now := time.Now()
+	nzbs := []NZB{
+		{GUID: "old", Trakt: 1, Failed: true, FailedAt: now.Add(-60 * 24 * time.Hour)},
+		{GUID: "unknown", Trakt: 1, Failed: true},
+		{GUID: "recent", Trakt: 1, Failed: true, FailedAt: now.Add(-time.Hour)},
+		{GUID: "ok", Trakt: 1},
+	}
+	for _, nzb := range nzbs {
+		if err := app.Store.Insert(nzb.GUID, nzb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := app.purgeFailedNZBs(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purged %d NZBs, want 2", purged)
+	}
+	for _, nzb := range nzbs {
+		err := app.Store.Get(nzb.GUID, &NZB{})
+		kept := err == nil
+		if want := nzb.GUID == "recent" || nzb.GUID == "ok"; kept != want {
+			t.Errorf("NZB %s kept = %v, want %v", nzb.GUID, kept, want)
+		}
+	}
+}
+
+func TestIsAllowedNZBHost(t *testing.T) {
+	app := newTestApp(t, Config{NZBAllowedHosts: []string{"indexer.example", "Mirror.Example"}})
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{"https://indexer.example/getnzb/1", true},
+		{"https://INDEXER.example:8443/getnzb/1", true},
+		{"https://mirror.example/getnzb/1", true},
+		{"https://indexer.example.evil/getnzb/1", false},
+		{"https://evil.example/getnzb/1?host=indexer.example", false},
+	}
+	for _, test := range tests {
+		got, err := app.isAllowedNZBHost(test.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("isAllowedNZBHost(%q) = %v, want %v", test.link, got, test.want)
+		}
+	}
+
+	app = newTestApp(t, Config{})
+	if allowed, _ := app.isAllowedNZBHost("https://anywhere.example/nzb"); !allowed {
+		t.Error("a link is refused without NZB_ALLOWED_HOSTS")
+	}
+}
+
+func TestParseFeedTreatsHTMLAsNoResults(t *testing.T) {
+	for _, response := range []string{
+		"<!DOCTYPE html><html><body>Down for maintenance</body></html>",
+		"  <html><head><title>502 Bad Gateway</title></head></html>",
+	} {
+		feed, err := parseFeed(response, false)
+		if err != nil {
+			t.Errorf("parseFeed(%q): %v", response, err)
+		}
+		if len(feed.Channel.Items) != 0 {
+			t.Errorf("parseFeed(%q) returned %d items", response, len(feed.Channel.Items))
+		}
+	}
+	if _, err := parseFeed("not a feed", false); err == nil {
+		t.Error("parseFeed accepted an invalid XML feed")
+	}
+}
+
+func TestSkipJSONAfterFailures(t *testing.T) {
+	app := newTestApp(t, Config{NewsNabJSONMaxFailures: 2})
+	app.JSONFailures.Add(1)
+	if app.skipJSON() {
+		t.Error("skipping JSON after one failure")
+	}
+	app.JSONFailures.Add(1)
+	if !app.skipJSON() {
+		t.Error("still trying JSON after two failures")
+	}
+
+	app = newTestApp(t, Config{})
+	app.JSONFailures.Add(10)
+	if app.skipJSON() {
+		t.Error("skipping JSON with NEWSNAB_JSON_MAX_FAILURES set to 0")
+	}
+}
+
+func TestNZBTierUntaggedRemux(t *testing.T) {
+	app := newTestApp(t, Config{UntaggedRemuxMinSize: 30 << 30})
+	tests := []struct {
+		title  string
+		length int64
+		want   string
+	}{
+		{"Movie.2010.1080p.BluRay.REMUX", 1 << 30, "remux"},
+		{"Movie.2010.1080p.WEB-DL", 40 << 30, "web-dl"},
+		{"Movie.2010.2160p.BluRay.HEVC", 40 << 30, "remux"},
+		{"Movie.2010.1080p.BluRay.x264", 10 << 30, "other"},
+	}
+	for _, test := range tests {
+		if got := app.nzbTier(test.title, test.length); got != test.want {
+			t.Errorf("nzbTier(%q, %d) = %q, want %q", test.title, test.length, got, test.want)
+		}
+	}
+
+	app = newTestApp(t, Config{})
+	if got := app.nzbTier("Movie.2010.2160p.BluRay.HEVC", 40<<30); got != "other" {
+		t.Errorf("nzbTier without UNTAGGED_REMUX_MIN_SIZE = %q, want other", got)
+	}
+}
+
+func TestRejectExcludedCategories(t *testing.T) {
+	app := newTestApp(t, Config{NewsNabExcludedCategories: []string{"2060"}})
+	item := newsnab.Item{
+		Title:       "Movie.2010.1080p",
+		Enclosure:   newsnab.Enclosure{URL: "https://indexer.example.com/getnzb/1"},
+		NewznabAttr: []newsnab.Attr{{Name: "category", Value: "2000"}, {Name: "category", Value: "2060"}},
+	}
+	if reason, err := app.nzbRejectReason(item, nil); err != nil || reason == "" {
+		t.Errorf("nzbRejectReason = %q, %v, want a category rejection", reason, err)
+	}
+	item.NewznabAttr = []newsnab.Attr{{Name: "category", Value: "2040"}}
+	if reason, err := app.nzbRejectReason(item, nil); err != nil || reason != "" {
+		t.Errorf("nzbRejectReason = %q, %v, want the item accepted", reason, err)
+	}
+}
+
+func TestRejectReleasesYoungerThanMinAge(t *testing.T) {
+	app := newTestApp(t, Config{MinReleaseAge: 2 * time.Hour})
+	item := newsnab.Item{
+		Title:     "Movie.2010.1080p",
+		Enclosure: newsnab.Enclosure{URL: "https://indexer.example.com/getnzb/1"},
+	}
+	tests := []struct {
+		pubDate  string
+		rejected bool
+	}{
+		{time.Now().Add(-time.Hour).Format(time.RFC1123Z), true},
+		{time.Now().Add(-3 * time.Hour).Format(time.RFC1123Z), false},
+		{"not a date", false},
+	}
+	for _, test := range tests {
+		item.PubDate = test.pubDate
+		reason, err := app.nzbRejectReason(item, nil)
+		if err != nil {
+			t.Fatalf("nzbRejectReason: %v", err)
+		}
+		if (reason != "") != test.rejected {
+			t.Errorf("published %q: reason %q, want rejected %v", test.pubDate, reason, test.rejected)
+		}
+	}
+}
+
+func TestLoadBlacklistReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blacklist.txt")
+	if err := os.WriteFile(path, []byte("cam\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	words, err := loadBlacklist(path)
+	if err != nil || len(words) != 1 {
+		t.Fatalf("loadBlacklist = %v, %v, want one word", words, err)
+	}
+
+	if err := os.WriteFile(path, []byte("cam\nts\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time moves even on coarse filesystem clocks.
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	words, err = loadBlacklist(path)
+	if err != nil || len(words) != 2 {
+		t.Errorf("loadBlacklist after a change = %v, %v, want two words", words, err)
+	}
+}
+
+func TestSearchDue(t *testing.T) {
+	config := Config{EpisodeSearchInterval: time.Hour}
+	movie := Media{Trakt: 1, LastSearchAt: time.Now().Add(-2 * time.Minute)}
+	episode := Media{Trakt: 2, Season: 1, Number: 1, LastSearchAt: time.Now().Add(-2 * time.Minute)}
+	oldEpisode := Media{Trakt: 3, Season: 1, Number: 2, LastSearchAt: time.Now().Add(-2 * time.Hour)}
+	tests := []struct {
+		config       Config
+		media        Media
+		betweenSyncs bool
+		want         bool
+	}{
+		// Without MOVIE_SEARCH_INTERVAL, movies are searched on every sync but not by the loop in between
+		{config, movie, false, true},
+		{config, movie, true, false},
+		{config, episode, false, false},
+		{config, episode, true, false},
+		{config, oldEpisode, true, true},
+		{Config{MovieSearchInterval: time.Minute}, movie, true, true},
+		{Config{MovieSearchInterval: time.Hour}, movie, false, false},
+		{Config{}, episode, false, true},
+	}
+	for i, test := range tests {
+		if got := test.config.searchDue(test.media, test.betweenSyncs); got != test.want {
+			t.Errorf("%d: searchDue(%d, between syncs %v) = %v, want %v", i, test.media.Trakt, test.betweenSyncs, got, test.want)
+		}
+	}
+}
+
+func TestSearchLoopInterval(t *testing.T) {
+	tests := []struct {
+		movie   time.Duration
+		episode time.Duration
+		want    time.Duration
+	}{
+		{0, 0, 0},
+		{time.Hour, 0, time.Hour},
+		{0, 30 * time.Minute, 30 * time.Minute},
+		{time.Hour, 30 * time.Minute, 30 * time.Minute},
+		{10 * time.Minute, 30 * time.Minute, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		config := Config{MovieSearchInterval: test.movie, EpisodeSearchInterval: test.episode}
+		if got := config.searchLoopInterval(); got != test.want {
+			t.Errorf("searchLoopInterval with %v and %v = %v, want %v", test.movie, test.episode, got, test.want)
+		}
+	}
+}
+
+func TestEpisodeTitleInSearch(t *testing.T) {
+	var query url.Values
+	host := fakeIndexer(t, newFakeAPI(map[string]http.HandlerFunc{
+		"/api": func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query()
+			replyFeed()(w, r)
+		},
+	}))
+	episode := Media{Trakt: 101, IMDB: "tt10", Title: "The Pilot", Season: 1, Number: 2}
+	movie := Media{Trakt: 1, IMDB: "tt0000001", Title: "Movie"}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		media   Media
+		q       string
+	}{
+		{"episode", false, episode, ""},
+		{"episode with its title", true, episode, "The Pilot"},
+		{"movie", true, movie, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(t, Config{NewsNabHost: host, EpisodeTitleInSearch: test.enabled})
+			query = nil
+			if _, err := app.searchNZB(test.media); err != nil {
+				t.Fatal(err)
+			}
+			if got := query.Get("q"); got != test.q {
+				t.Errorf("q = %q, want %q", got, test.q)
+			}
+			if !test.media.IsMovie() && (query.Get("season") != "1" || query.Get("ep") != "2") {
+				t.Errorf("episode searched as %v, want season 1 episode 2", query)
+			}
+		})
+	}
+}
+
+func TestSearchOnAddSearchesOnlyAddedMedias(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		searches int
+	}{
+		{"disabled", false, 0},
+		{"enabled", true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(map[string]http.HandlerFunc{"/api": replyFeed()})
+			host := fakeIndexer(t, api)
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "blacklist.txt"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			app := newTestApp(t, Config{DataDir: dir, NewsNabHost: host, SearchOnAdd: test.enabled})
+			if err := app.Store.Insert(int64(2), Media{Trakt: 2, IMDB: "tt2"}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, Trakt := range []int{1, 2} {
+				movie := &trakt.Movie{}
+				movie.Trakt = trakt.ID(Trakt)
+				movie.IMDB = trakt.IMDB(fmt.Sprintf("tt%d", Trakt))
+				if err := app.insertMovieToDB(movie); err != nil {
+					t.Fatal(err)
+				}
+			}
+			app.Tasks.Close()
+
+			if got := api.Calls("/api"); got != test.searches {
+				t.Errorf("searched %d times, want %d", got, test.searches)
+			}
+		})
+	}
+}
+
+func TestAvoidRetriedReleases(t *testing.T) {
+	tests := []struct {
+		name  string
+		avoid bool
+		tried []string
+		want  string
+	}{
+		{"nothing tried", true, nil, "remux"},
+		{"tried releases allowed", false, []string{"remux"}, "remux"},
+		{"remux tried", true, []string{"remux"}, "web"},
+		{"remux and web-dl tried", true, []string{"remux", "web"}, "other"},
+		{"everything tried", true, []string{"remux", "web", "other"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(t, Config{AvoidRetriedReleases: test.avoid})
+			if err := app.Store.Insert(int64(1), Media{Trakt: 1, TriedReleases: test.tried}); err != nil {
+				t.Fatal(err)
+			}
+			for _, nzb := range []NZB{
+				{GUID: "remux", Trakt: 1, Title: "Movie.2010.1080p.REMUX", Length: 30 << 30},
+				{GUID: "web", Trakt: 1, Title: "Movie.2010.1080p.WEB-DL", Length: 5 << 30},
+				{GUID: "other", Trakt: 1, Title: "Movie.2010.720p.HDTV", Length: 2 << 30},
+			} {
+				if err := app.Store.Insert(nzb.GUID, nzb); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			nzb, err := app.getNzbFromDB(1)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("picked %q, want no release", nzb.GUID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nzb.GUID != test.want {
+				t.Errorf("picked %q, want %q", nzb.GUID, test.want)
+			}
+		})
+	}
+}
+
+func TestDownloadedReleasesAreRecordedOnce(t *testing.T) {
+	app := newTestApp(t, Config{})
+	if err := app.Store.Insert(int64(1), Media{Trakt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, release := range []string{"remux", "web", "remux", ""} {
+		if err := updateMediaDownloadID(app.Store, 1, []string{"SABnzbd_nzo_1"}, release); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var media Media
+	if err := app.Store.Get(int64(1), &media); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"remux", "web"}; !slices.Equal(media.TriedReleases, want) {
+		t.Errorf("tried releases = %v, want %v", media.TriedReleases, want)
+	}
+}
+
+func TestDownloadingMediasAreNotSearched(t *testing.T) {
+	var searched []string
+	host := fakeIndexer(t, newFakeAPI(map[string]http.HandlerFunc{
+		"/api": func(w http.ResponseWriter, r *http.Request) {
+			searched = append(searched, r.URL.Query().Get("imdbid"))
+			replyFeed()(w, r)
+		},
+	}))
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "blacklist.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, Config{DataDir: dir, NewsNabHost: host})
+	for _, media := range []Media{{Trakt: 1, IMDB: "tt1"}, {Trakt: 2, IMDB: "tt2", DownloadID: "SABnzbd_nzo_2"}} {
+		if err := app.Store.Insert(media.Trakt, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Store.Insert("failed", NZB{GUID: "failed", Trakt: 2, Title: "Movie.2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		setup func() error
+		want  []string
+	}{
+		{"downloading", func() error { return nil }, []string{"1"}},
+		{"download failed", func() error { return downloadFailure(Failure{Message: "Movie.2"}, app) }, []string{"1", "2"}},
+	}
+	for _, step := range steps {
+		if err := step.setup(); err != nil {
+			t.Fatal(err)
+		}
+		searched = nil
+		if err := app.populateNZB(false); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(searched)
+		if !slices.Equal(searched, step.want) {
+			t.Errorf("%s: searched %v, want %v", step.name, searched, step.want)
+		}
+	}
+}
+
+func TestMediaWithoutIMDBIsSearchedByOtherIDs(t *testing.T) {
+	var query url.Values
+	host := fakeIndexer(t, newFakeAPI(map[string]http.HandlerFunc{
+		"/api": func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query()
+			replyFeed()(w, r)
+		},
+	}))
+	insertMovie := func(app App) error {
+		movie := &trakt.Movie{}
+		movie.Trakt, movie.TMDB = 1, 278
+		return app.insertMovieToDB(movie)
+	}
+	insertEpisode := func(app App) error {
+		show := &trakt.Show{}
+		show.Trakt, show.TVDB = 10, 81189
+		episode := &trakt.Episode{Season: 1, Number: 2}
+		episode.Trakt = 101
+		return app.insertEpisodeToDB(show, episode)
+	}
+	tests := []struct {
+		name    string
+		allow   bool
+		insert  func(app App) error
+		Trakt   int64
+		tracked bool
+		param   string
+		value   string
+	}{
+		{"movie not allowed", false, insertMovie, 1, false, "", ""},
+		{"movie by TMDB ID", true, insertMovie, 1, true, "tmdbid", "278"},
+		{"episode not allowed", false, insertEpisode, 101, false, "", ""},
+		{"episode by TVDB ID", true, insertEpisode, 101, true, "tvdbid", "81189"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(t, Config{NewsNabHost: host, AllowMissingIMDB: test.allow})
+			if err := test.insert(app); err != nil {
+				t.Fatal(err)
+			}
+			var media Media
+			err := app.Store.Get(test.Trakt, &media)
+			if tracked := err == nil; tracked != test.tracked {
+				t.Fatalf("tracked: %v, want %v", tracked, test.tracked)
+			}
+			if !test.tracked {
+				return
+			}
+			query = nil
+			if _, err := app.searchNZB(media); err != nil {
+				t.Fatal(err)
+			}
+			if got := query.Get(test.param); got != test.value || query.Has("imdbid") {
+				t.Errorf("searched with %v, want %s=%s", query, test.param, test.value)
+			}
+		})
+	}
+}
@@ -159,6 +159,67 @@ func (c *Client) Version(ctx context.Context) (*VersionResponse, error) {
 	return &data, nil
 }
 
+func (c *Client) Queue(ctx context.Context) (*QueueResponse, error) {
+	v := url.Values{}
+	v.Set("mode", "queue")
+	v.Set("output", "json")
+	v.Set("apikey", c.apiKey)
+
+	addr, err := url.JoinPath(c.addr, "/api")
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = v.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.basicUser != "" && c.basicPass != "" {
+		req.SetBasicAuth(c.basicUser, c.basicPass)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	body := bufio.NewReader(res.Body)
+	if _, err := body.Peek(1); err != nil && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("could not read body: %v", err)
+	}
+
+	var data QueueResponse
+	if err := json.NewDecoder(body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("could not unmarshal body: %v", err)
+	}
+
+	return &data, nil
+}
+
+type QueueResponse struct {
+	Queue Queue `json:"queue"`
+}
+
+type Queue struct {
+	Slots []QueueSlot `json:"slots"`
+}
+
+type QueueSlot struct {
+	NzoID    string `json:"nzo_id"`
+	Filename string `json:"filename"`
+	Status   string `json:"status"`
+}
+
 type VersionResponse struct {
 	Version string `json:"version"`
 }
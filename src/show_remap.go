@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+	"github.com/amaumene/momenarr/trakt"
+	log "github.com/sirupsen/logrus"
+)
+
+// remapShow moves the episodes and progress of a show from its old Trakt ID to its new
+// one, after Trakt split or merged it.
+func (app App) remapShow(from int64, to int64) error {
+	err := app.Store.UpdateMatching(&Media{}, bolthold.Where("Show").Eq(from), func(record interface{}) error {
+		update, ok := record.(*Media)
+		if !ok {
+			return fmt.Errorf("record isn't the correct type! Wanted Media, got %T", record)
+		}
+		update.Show = to
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("remapping episodes of show %d: %v", from, err)
+	}
+
+	var progress ShowProgress
+	err = app.Store.Get(from, &progress)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting progress of show %d: %v", from, err)
+	}
+	progress.Show = to
+	if err := app.Store.Insert(to, progress); err != nil && !errors.Is(err, ErrDuplicateKey) {
+		return fmt.Errorf("saving progress of show %d: %v", to, err)
+	}
+	if err := app.Store.Delete(from, &ShowProgress{}); err != nil {
+		return fmt.Errorf("deleting progress of show %d: %v", from, err)
+	}
+	return nil
+}
+
+// remapShowIDs applies SHOW_ID_REMAP.
+func (app App) remapShowIDs() {
+	for from, to := range app.Config().ShowIDRemap {
+		if err := app.remapShow(from, to); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("remapping show")
+		}
+	}
+}
+
+// detectShowRemap finds episodes stored under another Trakt ID for the same IMDB show
+// and moves them to its current ID.
+func (app App) detectShowRemap(show *trakt.Show) {
+	if len(show.IMDB) == 0 {
+		return
+	}
+	var medias []Media
+	err := app.Store.Find(&medias, bolthold.Where("IMDB").Eq(string(show.IMDB)).
+		And("Show").Ne(int64(0)).And("Show").Ne(int64(show.Trakt)))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("finding episodes under an old show ID")
+		return
+	}
+	remapped := make(map[int64]bool)
+	for _, media := range medias {
+		if remapped[media.Show] {
+			continue
+		}
+		remapped[media.Show] = true
+		log.WithFields(log.Fields{
+			"title": show.Title,
+			"from":  media.Show,
+			"to":    int64(show.Trakt),
+		}).Info("Show changed Trakt ID, moving its episodes")
+		if err := app.remapShow(media.Show, int64(show.Trakt)); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("remapping show")
+		}
+	}
+}
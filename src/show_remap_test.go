@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/amaumene/momenarr/trakt"
+	"testing"
+)
+
+func TestShowRemap(t *testing.T) {
+	tests := []struct {
+		name    string
+		remap   map[int64]int64
+		synced  int64
+		imdb    string
+		movedTo int64
+	}{
+		{"configured remap", map[int64]int64{10: 30}, 0, "", 30},
+		{"detected from the IMDB ID", nil, 30, "tt10", 30},
+		{"show without IMDB ID", nil, 30, "", 10},
+		{"same show", nil, 10, "tt10", 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(t, Config{ShowIDRemap: test.remap})
+			for _, media := range []Media{
+				{Trakt: 101, Show: 10, IMDB: "tt10", Season: 1, Number: 1},
+				{Trakt: 102, Show: 10, IMDB: "tt10", Season: 1, Number: 2},
+				{Trakt: 201, Show: 20, IMDB: "tt20", Season: 1, Number: 1},
+			} {
+				if err := app.Store.Insert(media.Trakt, media); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := app.Store.Insert(int64(10), ShowProgress{Show: 10, Season: 1, Number: 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			app.remapShowIDs()
+			if test.synced > 0 {
+				show := &trakt.Show{}
+				show.Trakt = trakt.ID(test.synced)
+				show.IMDB = trakt.IMDB(test.imdb)
+				app.detectShowRemap(show)
+			}
+
+			for Trakt, show := range map[int64]int64{101: test.movedTo, 102: test.movedTo, 201: 20} {
+				var media Media
+				if err := app.Store.Get(Trakt, &media); err != nil {
+					t.Fatal(err)
+				}
+				if media.Show != show {
+					t.Errorf("episode %d is in show %d, want %d", Trakt, media.Show, show)
+				}
+			}
+			var progress ShowProgress
+			if err := app.Store.Get(test.movedTo, &progress); err != nil || progress.Show != test.movedTo {
+				t.Errorf("progress of show %d = %+v, %v", test.movedTo, progress, err)
+			}
+			if test.movedTo != 10 {
+				if err := app.Store.Get(int64(10), &ShowProgress{}); err == nil {
+					t.Error("progress still under the old show ID")
+				}
+			}
+		})
+	}
+}
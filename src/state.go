@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+	bolt "go.etcd.io/bbolt"
+)
+
+type State struct {
+	Media         []Media         `json:"media"`
+	NZBs          []NZB           `json:"nzbs"`
+	ShowProgress  []ShowProgress  `json:"show_progress"`
+	Archive       []ArchivedMedia `json:"archive"`
+	Notifications []Notification  `json:"notifications"`
+	Acquisitions  []Acquisition   `json:"acquisitions"`
+}
+
+func (app App) exportState() (State, error) {
+	state := State{
+		Media:         []Media{},
+		NZBs:          []NZB{},
+		ShowProgress:  []ShowProgress{},
+		Archive:       []ArchivedMedia{},
+		Notifications: []Notification{},
+		Acquisitions:  []Acquisition{},
+	}
+	err := app.Store.Bolt().View(func(tx *bolt.Tx) error {
+		if err := app.Store.TxFind(tx, &state.Media, &bolthold.Query{}); err != nil {
+			return fmt.Errorf("exporting media: %v", err)
+		}
+		if err := app.Store.TxFind(tx, &state.NZBs, &bolthold.Query{}); err != nil {
+			return fmt.Errorf("exporting NZBs: %v", err)
+		}
+		if err := app.Store.TxFind(tx, &state.ShowProgress, &bolthold.Query{}); err != nil {
+			return fmt.Errorf("exporting show progress: %v", err)
+		}
+		if err := app.Store.TxFind(tx, &state.Archive, &bolthold.Query{}); err != nil {
+			return fmt.Errorf("exporting archive: %v", err)
+		}
+		if err := app.Store.TxFind(tx, &state.Notifications, &bolthold.Query{}); err != nil {
+			return fmt.Errorf("exporting notifications: %v", err)
+		}
+		if err := app.Store.TxFind(tx, &state.Acquisitions, &bolthold.Query{}); err != nil {
+			return fmt.Errorf("exporting acquisitions: %v", err)
+		}
+		return nil
+	})
+	return state, err
+}
+
+// importState writes state to the store, replacing everything in it when replace is set
+// and otherwise only overwriting the records with the same keys.
+func (app App) importState(state State, replace bool) ([]int64, error) {
+	var added []int64
+	err := app.Store.Bolt().Update(func(tx *bolt.Tx) error {
+		added = nil
+		if replace {
+			for _, dataType := range []interface{}{&Media{}, &NZB{}, &ShowProgress{}, &ArchivedMedia{}, &Notification{}, &Acquisition{}} {
+				if err := app.Store.TxDeleteMatching(tx, dataType, &bolthold.Query{}); err != nil {
+					return fmt.Errorf("clearing %T: %v", dataType, err)
+				}
+			}
+		}
+		for _, media := range state.Media {
+			var existing Media
+			err := app.Store.TxGet(tx, media.Trakt, &existing)
+			if errors.Is(err, ErrNotFound) {
+				added = append(added, media.Trakt)
+			} else if err != nil {
+				return fmt.Errorf("getting media %d: %v", media.Trakt, err)
+			}
+			if err := app.Store.TxUpsert(tx, media.Trakt, media); err != nil {
+				return fmt.Errorf("importing media %d: %v", media.Trakt, err)
+			}
+		}
+		for _, nzb := range state.NZBs {
+			if nzb.GUID == "" {
+				return fmt.Errorf("importing NZB %s: missing guid", nzb.Title)
+			}
+			if err := app.Store.TxUpsert(tx, nzb.GUID, nzb); err != nil {
+				return fmt.Errorf("importing NZB %s: %v", nzb.GUID, err)
+			}
+		}
+		for _, progress := range state.ShowProgress {
+			if err := app.Store.TxUpsert(tx, progress.Show, progress); err != nil {
+				return fmt.Errorf("importing show progress %d: %v", progress.Show, err)
+			}
+		}
+		for _, archived := range state.Archive {
+			if err := app.Store.TxUpsert(tx, archived.Trakt, archived); err != nil {
+				return fmt.Errorf("importing archived media %d: %v", archived.Trakt, err)
+			}
+		}
+		for _, notification := range state.Notifications {
+			if err := app.Store.TxUpsert(tx, notification.Key, notification); err != nil {
+				return fmt.Errorf("importing notification %s: %v", notification.Key, err)
+			}
+		}
+		var lastID uint64
+		for _, acquisition := range state.Acquisitions {
+			if acquisition.ID == 0 {
+				return fmt.Errorf("importing acquisition: missing id")
+			}
+			if err := app.Store.TxUpsert(tx, acquisition.ID, acquisition); err != nil {
+				return fmt.Errorf("importing acquisition %d: %v", acquisition.ID, err)
+			}
+			lastID = max(lastID, acquisition.ID)
+		}
+		// Acquisitions recorded after the import take the next IDs, which must not collide with the imported ones
+		if bucket := tx.Bucket([]byte("Acquisition")); bucket != nil && bucket.Sequence() < lastID {
+			if err := bucket.SetSequence(lastID); err != nil {
+				return fmt.Errorf("updating acquisition sequence: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/amaumene/momenarr/bolthold"
+	"testing"
+	"time"
+)
+
+func seedState(t *testing.T, app App) {
+	t.Helper()
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	records := []struct {
+		key    interface{}
+		record interface{}
+	}{
+		{int64(1), Media{Trakt: 1, IMDB: "tt1", Title: "Movie", Year: 2020, OnDisk: true, File: "/movies/movie.mkv", DownloadedAt: at, Tags: []string{"kids"}}},
+		{int64(2), Media{Trakt: 2, Show: 20, IMDB: "tt20", Season: 1, Number: 3, Title: "Episode", DownloadID: "nzo2", TriedReleases: []string{"nzb2"}}},
+		{"nzb2", NZB{GUID: "nzb2", Trakt: 2, Title: "Show.S01E03.1080p", Link: "https://indexer/nzb2", Length: 100}},
+		{int64(20), ShowProgress{Show: 20, Season: 1, Number: 3, ResetAt: at}},
+		{int64(3), ArchivedMedia{Media: Media{Trakt: 3, IMDB: "tt3", Title: "Old"}, ArchivedAt: at}},
+		{"success:nzo2:", Notification{Key: "success:nzo2:", ReceivedAt: at}},
+		{bolthold.NextSequence(), &Acquisition{Movie: true, Resolution: "1080p", Source: "remux", Size: 100, Chosen: true, RemovedAt: at}},
+		{bolthold.NextSequence(), &Acquisition{Resolution: "720p", Source: "web-dl", Size: 50, Failed: true, RemovedAt: at}},
+	}
+	for _, record := range records {
+		if err := app.Store.Insert(record.key, record.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exportJSON(t *testing.T, app App) []byte {
+	t.Helper()
+	state, err := app.exportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source := newTestApp(t, Config{})
+	seedState(t, source)
+	exported := exportJSON(t, source)
+
+	var state State
+	if err := json.Unmarshal(exported, &state); err != nil {
+		t.Fatal(err)
+	}
+	target := newTestApp(t, Config{})
+	added, err := target.importState(state, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 {
+		t.Errorf("added = %v, want both media", added)
+	}
+	if imported := exportJSON(t, target); !bytes.Equal(imported, exported) {
+		t.Errorf("imported state differs from the export:\n%s\nwant\n%s", imported, exported)
+	}
+	// Acquisitions recorded after the import must not reuse the imported IDs
+	if err := target.Store.Insert(bolthold.NextSequence(), &Acquisition{Resolution: "2160p"}); err != nil {
+		t.Errorf("recording an acquisition after the import: %v", err)
+	}
+}
+
+func TestImportReplaceClearsStore(t *testing.T) {
+	app := newTestApp(t, Config{})
+	seedState(t, app)
+	state := State{Media: []Media{{Trakt: 9, IMDB: "tt9"}}}
+	if _, err := app.importState(state, true); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := app.exportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Media) != 1 || exported.Media[0].Trakt != 9 || len(exported.NZBs) != 0 || len(exported.ShowProgress) != 0 ||
+		len(exported.Archive) != 0 || len(exported.Notifications) != 0 || len(exported.Acquisitions) != 0 {
+		t.Errorf("state after replace = %+v, want only the imported media", exported)
+	}
+}
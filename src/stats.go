@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amaumene/momenarr/bolthold"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+type StorageGroup struct {
+	Resolution string `json:"resolution"`
+	Source     string `json:"source"`
+	Count      int    `json:"count"`
+	Size       int64  `json:"size"`
+}
+
+var (
+	resolutionPattern = regexp.MustCompile(`(?i)\b(2160p|1080p|720p|576p|480p)\b`)
+	sourcePatterns    = []struct {
+		name    string
+		pattern *regexp.Regexp
+	}{
+		{"remux", regexp.MustCompile(`(?i)remux`)},
+		{"web-dl", regexp.MustCompile(`(?i)web-?dl`)},
+		{"webrip", regexp.MustCompile(`(?i)webrip`)},
+		{"bluray", regexp.MustCompile(`(?i)blu-?ray|bdrip`)},
+		{"hdtv", regexp.MustCompile(`(?i)hdtv`)},
+	}
+)
+
+// parseRelease reads the resolution and source from a release or file name, "unknown"
+// and "other" when they can't be told.
+func parseRelease(name string) (string, string) {
+	resolution := "unknown"
+	if match := resolutionPattern.FindString(name); match != "" {
+		resolution = match
+	}
+	source := "other"
+	for _, candidate := range sourcePatterns {
+		if candidate.pattern.MatchString(name) {
+			source = candidate.name
+			break
+		}
+	}
+	return resolution, source
+}
+
+// chosenRelease returns the title of the last release sent to SABnzbd for media, or the name
+// of its file when that NZB is gone. The file may have been renamed since.
+func (app App) chosenRelease(media Media) string {
+	if len(media.TriedReleases) > 0 {
+		var nzb NZB
+		if err := app.Store.Get(media.TriedReleases[len(media.TriedReleases)-1], &nzb); err == nil && nzb.Title != "" {
+			return nzb.Title
+		}
+	}
+	return filepath.Base(media.File)
+}
+
+// storageStats groups the files on disk by resolution and source, biggest groups first.
+func (app App) storageStats() ([]StorageGroup, error) {
+	var medias []Media
+	if err := app.Store.Find(&medias, bolthold.Where("OnDisk").Eq(true)); err != nil {
+		return nil, fmt.Errorf("finding media on disk in database: %v", err)
+	}
+
+	groups := make(map[[2]string]*StorageGroup)
+	for _, media := range medias {
+		info, err := os.Stat(media.File)
+		if err != nil {
+			continue
+		}
+		resolution, source := parseRelease(app.chosenRelease(media))
+		key := [2]string{resolution, source}
+		group, ok := groups[key]
+		if !ok {
+			group = &StorageGroup{Resolution: resolution, Source: source}
+			groups[key] = group
+		}
+		group.Count++
+		group.Size += info.Size()
+	}
+
+	stats := make([]StorageGroup, 0, len(groups))
+	for _, group := range groups {
+		stats = append(stats, *group)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Size > stats[j].Size
+	})
+	return stats, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRelease(t *testing.T) {
+	tests := []struct {
+		name       string
+		resolution string
+		source     string
+	}{
+		{"Movie.2010.2160p.UHD.BluRay.REMUX.HDR", "2160p", "remux"},
+		{"Movie.2010.1080p.WEB-DL.DDP5.1", "1080p", "web-dl"},
+		{"Show.S01E02.720p.WEBRip.x264", "720p", "webrip"},
+		{"Movie.2010.1080p.BluRay.x264", "1080p", "bluray"},
+		{"Show.S01E02.HDTV.x264", "unknown", "hdtv"},
+		{"movie.mkv", "unknown", "other"},
+	}
+	for _, test := range tests {
+		resolution, source := parseRelease(test.name)
+		if resolution != test.resolution || source != test.source {
+			t.Errorf("parseRelease(%q) = %q, %q, want %q, %q", test.name, resolution, source, test.resolution, test.source)
+		}
+	}
+}
+
+func TestStorageStatsUseTheChosenRelease(t *testing.T) {
+	app := newTestApp(t, Config{})
+	dir := t.TempDir()
+	files := map[string]int{"renamed.mkv": 300, "Show.S01E02.720p.WEBRip.mkv": 100}
+	for name, size := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, record := range map[interface{}]interface{}{
+		"old":    NZB{GUID: "old", Trakt: 1, Title: "Movie.2010.1080p.WEB-DL"},
+		"chosen": NZB{GUID: "chosen", Trakt: 1, Title: "Movie.2010.2160p.BluRay.REMUX"},
+		int64(1): Media{Trakt: 1, OnDisk: true, File: filepath.Join(dir, "renamed.mkv"), TriedReleases: []string{"old", "chosen"}},
+		// Its NZB was purged, so the file name is all there is to go on
+		int64(2): Media{Trakt: 2, Show: 20, Season: 1, Number: 2, OnDisk: true, File: filepath.Join(dir, "Show.S01E02.720p.WEBRip.mkv"), TriedReleases: []string{"purged"}},
+	} {
+		if err := app.Store.Insert(key, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := app.storageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StorageGroup{
+		{Resolution: "2160p", Source: "remux", Count: 1, Size: 300},
+		{Resolution: "720p", Source: "webrip", Count: 1, Size: 100},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("stats = %+v, want %+v", stats, want)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("group %d = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// RunSummary counts what a run of the tasks did.
+type RunSummary struct {
+	StartedAt  time.Time
+	Synced     int
+	Pruned     int
+	Downloaded int
+	Cleaned    int
+	Failed     int
+}
+
+func (summary RunSummary) String() string {
+	return fmt.Sprintf("synced %d, pruned %d, downloaded %d, cleaned %d, failed %d in %s",
+		summary.Synced, summary.Pruned, summary.Downloaded, summary.Cleaned, summary.Failed,
+		time.Since(summary.StartedAt).Round(time.Second))
+}
+
+// reportRun logs the summary of a run and mails it when RUN_SUMMARY_MAIL is set.
+func (app App) reportRun(summary *RunSummary) {
+	log.WithFields(log.Fields{
+		"synced":     summary.Synced,
+		"pruned":     summary.Pruned,
+		"downloaded": summary.Downloaded,
+		"cleaned":    summary.Cleaned,
+		"failed":     summary.Failed,
+		"duration":   time.Since(summary.StartedAt).Round(time.Second),
+	}).Info("Tasks ran")
+	if !app.Config().RunSummaryMail || app.Config().SMTPHost == "" || len(app.Config().SMTPTo) == 0 {
+		return
+	}
+	if err := app.Config().sendMail("momenarr run summary", summary.String()+"\n"); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("sending run summary")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus/hooks/test"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSummaryIsLoggedAndMailed(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	tests := []struct {
+		name   string
+		mail   bool
+		mailed bool
+	}{
+		{"logged only", false, false},
+		{"mailed", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook.Reset()
+			host, port, messages := fakeSMTP(t)
+			app := newTestApp(t, Config{RunSummaryMail: test.mail, SMTPHost: host, SMTPPort: port, SMTPFrom: "momenarr@example.com", SMTPTo: []string{"me@example.com"}})
+
+			app.reportRun(&RunSummary{StartedAt: time.Now(), Synced: 3, Pruned: 1, Downloaded: 2, Failed: 1})
+			entry := hook.LastEntry()
+			if entry == nil || entry.Message != "Tasks ran" || entry.Data["synced"] != 3 || entry.Data["downloaded"] != 2 || entry.Data["failed"] != 1 {
+				t.Errorf("run logged as %+v, want the summary", entry)
+			}
+			select {
+			case message := <-messages:
+				if !test.mailed {
+					t.Errorf("summary mailed without RUN_SUMMARY_MAIL: %q", message)
+				}
+				if !strings.Contains(message, "synced 3, pruned 1, downloaded 2, cleaned 0, failed 1") {
+					t.Errorf("mailed %q, want the summary", message)
+				}
+			default:
+				if test.mailed {
+					t.Error("summary not mailed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func (app App) updateMediaTags(Trakt int64, tags []string, add bool) (Media, error) {
+	var media Media
+	if err := app.Store.Get(Trakt, &media); err != nil {
+		return media, fmt.Errorf("getting media from database: %w", err)
+	}
+
+	changed := make(map[string]bool)
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); tag != "" {
+			changed[tag] = true
+		}
+	}
+	var updated []string
+	for _, tag := range media.Tags {
+		if !changed[tag] {
+			updated = append(updated, tag)
+		}
+	}
+	if add {
+		for tag := range changed {
+			updated = append(updated, tag)
+		}
+	}
+	sort.Strings(updated)
+	media.Tags = updated
+
+	if err := app.Store.Update(Trakt, media); err != nil {
+		return media, fmt.Errorf("updating media tags in database: %v", err)
+	}
+	return media, nil
+}
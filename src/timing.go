@@ -0,0 +1,40 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+func (app App) timeCall(name string, call func() error) error {
+	start := time.Now()
+	err := call()
+	duration := time.Since(start)
+
+	fields := log.Fields{
+		"call":     name,
+		"duration": duration,
+		"success":  err == nil,
+	}
+	if app.Config().SlowCallThreshold > 0 && duration > app.Config().SlowCallThreshold {
+		log.WithFields(fields).Warning("Slow external call")
+	} else {
+		log.WithFields(fields).Debug("External call")
+	}
+	return err
+}
+
+// pager is what timedNext needs of the Trakt list iterators.
+type pager interface {
+	Next() bool
+	Err() error
+}
+
+// timedNext advances iterator, timing as name the page requests it makes to Trakt.
+func (app App) timedNext(name string, iterator pager) bool {
+	var more bool
+	app.timeCall(name, func() error {
+		more = iterator.Next()
+		return iterator.Err()
+	})
+	return more
+}
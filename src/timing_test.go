@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"testing"
+	"time"
+)
+
+func TestSlowCallIsLogged(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	app := newTestApp(t, Config{SlowCallThreshold: 10 * time.Millisecond})
+
+	app.timeCall("fast", func() error { return nil })
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			t.Errorf("fast call logged as slow: %v", entry.Data)
+		}
+	}
+
+	hook.Reset()
+	err := app.timeCall("trakt.EpisodeGet", func() error {
+		time.Sleep(20 * time.Millisecond)
+		return errors.New("timeout")
+	})
+	if err == nil {
+		t.Error("timeCall dropped the call error")
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != log.WarnLevel || entry.Data["call"] != "trakt.EpisodeGet" || entry.Data["success"] != false {
+		t.Errorf("slow call logged as %+v, want a warning for trakt.EpisodeGet", entry)
+	}
+}
+
+type fakePager struct {
+	pages []time.Duration
+	err   error
+}
+
+func (p *fakePager) Next() bool {
+	if len(p.pages) == 0 {
+		return false
+	}
+	time.Sleep(p.pages[0])
+	p.pages = p.pages[1:]
+	return true
+}
+
+func (p *fakePager) Err() error {
+	return p.err
+}
+
+func TestTimedNextLogsSlowPages(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	app := newTestApp(t, Config{SlowCallThreshold: 10 * time.Millisecond})
+
+	iterator := &fakePager{pages: []time.Duration{0, 20 * time.Millisecond}}
+	items := 0
+	for app.timedNext("trakt.History", iterator) {
+		items++
+	}
+	if items != 2 {
+		t.Errorf("iterated over %d items, want 2", items)
+	}
+	slow := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && entry.Data["call"] == "trakt.History" {
+			slow++
+		}
+	}
+	if slow != 1 {
+		t.Errorf("%d slow pages logged, want 1", slow)
+	}
+}
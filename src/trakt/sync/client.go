@@ -256,7 +256,7 @@ func Favorites(params *trakt.ListFavoritesParams) *trakt.FavoritesEntryIterator
 }
 
 func (c *client) Favorites(params *trakt.ListFavoritesParams) *trakt.FavoritesEntryIterator {
-	path := trakt.FormatURLPath("/sync/favorites/%s", params.Type)
+	path := trakt.FormatURLPath("/sync/favorites/%s", params.Type.Plural())
 	return &trakt.FavoritesEntryIterator{Iterator: c.b.NewIterator(http.MethodGet, path, params)}
 }
 
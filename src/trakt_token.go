@@ -5,10 +5,27 @@ import (
 	"fmt"
 	"github.com/amaumene/momenarr/trakt"
 	"github.com/amaumene/momenarr/trakt/authorization"
-	"log"
+	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
+	"time"
 )
 
+const (
+	redirectURI        = "urn:ietf:wg:oauth:2.0:oob"
+	tokenRefreshMargin = time.Hour
+)
+
+// storedToken is how a token is saved, trakt.Token doesn't marshal its creation time and lifetime
+type storedToken struct {
+	AccessToken  string `json:"access_token"`
+	Type         string `json:"token_type"`
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token"`
+	CreatedAt    int64  `json:"created_at"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
 func getToken(clientSecret string, tokenFile string) (*trakt.Token, error) {
 	if _, err := os.Stat(tokenFile); err == nil {
 		return loadTokenFromFile(tokenFile)
@@ -17,6 +34,11 @@ func getToken(clientSecret string, tokenFile string) (*trakt.Token, error) {
 }
 
 func loadTokenFromFile(tokenFile string) (*trakt.Token, error) {
+	if info, err := os.Stat(tokenFile); err == nil && info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(tokenFile, 0600); err != nil {
+			return nil, fmt.Errorf("error restricting token file permissions: %v", err)
+		}
+	}
 	file, err := os.Open(tokenFile)
 	if err != nil {
 		return nil, fmt.Errorf("error opening token file: %v", err)
@@ -41,7 +63,10 @@ func generateNewToken(clientSecret string, tokenFile string) (*trakt.Token, erro
 		return nil, fmt.Errorf("error generating device code: %v", err)
 	}
 
-	fmt.Printf("Please go to %s and enter the code: %s\n", deviceCode.VerificationURL, deviceCode.UserCode)
+	log.WithFields(log.Fields{
+		"url":  deviceCode.VerificationURL,
+		"code": deviceCode.UserCode,
+	}).Warning("Trakt authorization required, please go to the URL and enter the code")
 
 	pollParams := &trakt.PollCodeParams{
 		Code:         deviceCode.Code,
@@ -61,31 +86,107 @@ func generateNewToken(clientSecret string, tokenFile string) (*trakt.Token, erro
 }
 
 func saveTokenToFile(token *trakt.Token, tokenFile string) error {
-	file, err := os.Create(tokenFile)
+	file, err := os.CreateTemp(filepath.Dir(tokenFile), filepath.Base(tokenFile)+".tmp")
 	if err != nil {
-		return fmt.Errorf("error creating token file: %v", err)
+		return fmt.Errorf("error creating temporary token file: %v", err)
 	}
 	defer func() {
-		if err := file.Close(); err != nil {
-			err = fmt.Errorf("error closing the file: %v", err)
-		}
+		_ = os.Remove(file.Name())
 	}()
 
+	if err := file.Chmod(0600); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("error setting token file permissions: %v", err)
+	}
 	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(token); err != nil {
+	if err := encoder.Encode(storedToken{
+		AccessToken:  token.AccessToken,
+		Type:         token.Type,
+		Scope:        token.Scope,
+		RefreshToken: token.RefreshToken,
+		CreatedAt:    token.CreatedAt.Unix(),
+		ExpiresIn:    int64(token.ExpiresIn.Seconds()),
+	}); err != nil {
+		_ = file.Close()
 		return fmt.Errorf("error encoding token to JSON: %v", err)
 	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("error syncing token file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing the file: %v", err)
+	}
+	if err := os.Rename(file.Name(), tokenFile); err != nil {
+		return fmt.Errorf("error moving token file into place: %v", err)
+	}
 	return nil
 }
 
 func (app App) setUpTrakt(traktApiKey string, traktClientSecret string) *trakt.Token {
 	trakt.Key = traktApiKey
 
-	tokenFile := app.Config.DataDir + "/token.json"
-
-	token, err := getToken(traktClientSecret, tokenFile)
+	token, err := getToken(traktClientSecret, app.Config().TokenFile)
 	if err != nil {
 		log.Fatalf("Error getting token: %v", err)
 	}
 	return token
 }
+
+// tokenNeedsRefresh tells whether token expires within margin. The local clock may be off
+// by up to skew, so the token is refreshed that much earlier.
+func tokenNeedsRefresh(token *trakt.Token, now time.Time, skew time.Duration, margin time.Duration) bool {
+	if token.CreatedAt.After(now.Add(skew)) {
+		log.WithFields(log.Fields{
+			"created_at": token.CreatedAt,
+			"now":        now,
+		}).Warning("Trakt token was issued in the future, the local clock is probably wrong")
+	}
+	expiresAt := token.CreatedAt.Add(token.ExpiresIn)
+	return !now.Add(skew + margin).Before(expiresAt)
+}
+
+// tokenMargin is how long before it expires the token is refreshed. The token is only
+// checked at the start of a run, so it must last until the next one.
+func (config Config) tokenMargin() time.Duration {
+	if config.SyncInterval > tokenRefreshMargin {
+		return config.SyncInterval + tokenRefreshMargin
+	}
+	return tokenRefreshMargin
+}
+
+func (app App) refreshTraktToken() error {
+	if !tokenNeedsRefresh(app.TraktToken, time.Now(), app.Config().TokenClockSkew, app.Config().tokenMargin()) {
+		return nil
+	}
+	var token *trakt.Token
+	err := app.timeCall("trakt.RefreshToken", func() error {
+		var err error
+		token, err = authorization.RefreshToken(&trakt.RefreshTokenParams{
+			RedirectURI:  redirectURI,
+			RefreshToken: app.TraktToken.RefreshToken,
+			ClientSecret: app.Config().TraktClientSecret,
+		})
+		return err
+	})
+	if err != nil {
+		if !app.Config().TraktDeviceReauth {
+			return fmt.Errorf("refreshing token: %v", err)
+		}
+		log.WithFields(log.Fields{"err": err}).Error("refreshing token, starting device authorization")
+		// generateNewToken polls until the code is entered or expires and saves the token itself
+		token, err = generateNewToken(app.Config().TraktClientSecret, app.Config().TokenFile)
+		if err != nil {
+			return fmt.Errorf("authorizing device after failed refresh: %v", err)
+		}
+		*app.TraktToken = *token
+		log.Info("Trakt token renewed through device authorization")
+		return nil
+	}
+	if err := saveTokenToFile(token, app.Config().TokenFile); err != nil {
+		return err
+	}
+	*app.TraktToken = *token
+	log.Info("Trakt token refreshed")
+	return nil
+}
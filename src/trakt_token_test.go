@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/amaumene/momenarr/trakt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenNeedsRefreshRespectsSkew(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// Expires in 90 minutes, so 30 minutes past the one hour margin
+	token := &trakt.Token{CreatedAt: now.Add(-time.Hour), ExpiresIn: 150 * time.Minute}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		skew time.Duration
+		want bool
+	}{
+		{"accurate clock", now, 0, false},
+		{"clock within tolerance", now, 20 * time.Minute, false},
+		{"clock skew past the margin", now, 45 * time.Minute, true},
+		{"clock behind, still near expiry", now.Add(40 * time.Minute), 0, true},
+	}
+	for _, test := range tests {
+		if got := tokenNeedsRefresh(token, test.now, test.skew, tokenRefreshMargin); got != test.want {
+			t.Errorf("%s: tokenNeedsRefresh = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTokenMarginCoversSyncInterval(t *testing.T) {
+	config := Config{SyncInterval: 6 * time.Hour}
+	now := time.Now()
+	// Valid for 4 more hours, past the one hour margin but not until the next run
+	token := &trakt.Token{CreatedAt: now.Add(-20 * time.Hour), ExpiresIn: 24 * time.Hour}
+	if !tokenNeedsRefresh(token, now, 0, config.tokenMargin()) {
+		t.Error("token expiring before the next run isn't refreshed")
+	}
+}
+
+func TestTokenIssuedInTheFuture(t *testing.T) {
+	now := time.Now()
+	token := &trakt.Token{CreatedAt: now.Add(time.Hour), ExpiresIn: 24 * time.Hour}
+	if tokenNeedsRefresh(token, now, 0, tokenRefreshMargin) {
+		t.Error("fresh token issued by a server ahead of the local clock is refreshed")
+	}
+}
+
+func TestSaveTokenToFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token.json")
+	token := &trakt.Token{
+		AccessToken:  "access",
+		Type:         "bearer",
+		Scope:        "public",
+		RefreshToken: "refresh",
+		CreatedAt:    time.Unix(1700000000, 0),
+		ExpiresIn:    24 * time.Hour,
+	}
+	if err := os.WriteFile(tokenFile, []byte("previous"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTokenToFile(token, tokenFile); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadTokenFromFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AccessToken != token.AccessToken || loaded.RefreshToken != token.RefreshToken ||
+		!loaded.CreatedAt.Equal(token.CreatedAt) || loaded.ExpiresIn != token.ExpiresIn {
+		t.Errorf("loaded token = %+v, want %+v", loaded, token)
+	}
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("token file mode = %v, want 0600", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the token directory, want no temporary file left", len(entries))
+	}
+}
+
+func TestDeviceReauthAfterFailedRefresh(t *testing.T) {
+	token := func(access string) http.HandlerFunc {
+		return replyJSON(map[string]interface{}{"access_token": access, "refresh_token": "refresh", "created_at": time.Now().Unix(), "expires_in": 7776000})
+	}
+	tests := []struct {
+		name    string
+		refresh http.HandlerFunc
+		reauth  bool
+		want    string
+		device  int
+	}{
+		{"refreshed", token("refreshed"), true, "refreshed", 0},
+		{"refresh failed", replyStatus(http.StatusUnauthorized), false, "", 0},
+		{"authorized device", replyStatus(http.StatusUnauthorized), true, "authorized", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(map[string]http.HandlerFunc{
+				"/oauth/token":        test.refresh,
+				"/oauth/device/code":  replyJSON(map[string]interface{}{"device_code": "device", "user_code": "USER", "verification_url": "https://trakt.tv/activate", "interval": 1, "expires_in": 60}),
+				"/oauth/device/token": token("authorized"),
+			})
+			fakeTrakt(t, api)
+			tokenFile := filepath.Join(t.TempDir(), "token.json")
+			app := newTestApp(t, Config{TokenFile: tokenFile, TraktDeviceReauth: test.reauth})
+			*app.TraktToken = trakt.Token{AccessToken: "expired", RefreshToken: "refresh", CreatedAt: time.Now().Add(-100 * 24 * time.Hour), ExpiresIn: 90 * 24 * time.Hour}
+
+			err := app.refreshTraktToken()
+			if test.want == "" {
+				if err == nil {
+					t.Error("refreshing succeeded")
+				}
+				if app.TraktToken.AccessToken != "expired" {
+					t.Errorf("token replaced by %q", app.TraktToken.AccessToken)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if app.TraktToken.AccessToken != test.want {
+					t.Errorf("token = %q, want %q", app.TraktToken.AccessToken, test.want)
+				}
+				saved, err := loadTokenFromFile(tokenFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if saved.AccessToken != test.want {
+					t.Errorf("saved token = %q, want %q", saved.AccessToken, test.want)
+				}
+			}
+			if got := api.Calls("/oauth/device/code"); got != test.device {
+				t.Errorf("device code requested %d times, want %d", got, test.device)
+			}
+		})
+	}
+}
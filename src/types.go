@@ -1,43 +1,203 @@
 package main
 
 import (
+	"context"
 	"github.com/amaumene/momenarr/bolthold"
 	"github.com/amaumene/momenarr/sabnzbd"
 	"github.com/amaumene/momenarr/trakt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type App struct {
 	TraktToken *trakt.Token
 	Store      *bolthold.Store
 	SabNZBd    *sabnzbd.Client
-	Config     *Config
+	// config is swapped as a whole by /api/admin/reload, read it through Config()
+	config   *atomic.Pointer[Config]
+	Tasks    *TaskGroup
+	Running  *sync.Mutex
+	InFlight *InFlight
+	// JSONFailures counts the JSON searches that failed in the current run
+	JSONFailures *atomic.Int64
+}
+
+func (app App) Config() *Config {
+	return app.config.Load()
+}
+
+// TaskGroup tracks the work that must finish before the database is closed. Once it is
+// closed for shutdown, no new work starts.
+type TaskGroup struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Context returns a context cancelled once shutdown begins, for work that can be cut short.
+func (tasks *TaskGroup) Context() context.Context {
+	tasks.mu.Lock()
+	defer tasks.mu.Unlock()
+	if tasks.ctx == nil {
+		tasks.ctx, tasks.cancel = context.WithCancel(context.Background())
+	}
+	return tasks.ctx
+}
+
+// Start registers a new piece of work, or returns false when shutting down.
+func (tasks *TaskGroup) Start() bool {
+	tasks.mu.Lock()
+	defer tasks.mu.Unlock()
+	if tasks.closed {
+		return false
+	}
+	tasks.wg.Add(1)
+	return true
+}
+
+func (tasks *TaskGroup) Done() {
+	tasks.wg.Done()
+}
+
+// Close stops new work from starting, cancels the context of the running work and waits
+// for it to finish.
+func (tasks *TaskGroup) Close() {
+	tasks.mu.Lock()
+	tasks.closed = true
+	if tasks.cancel != nil {
+		tasks.cancel()
+	}
+	tasks.mu.Unlock()
+	tasks.wg.Wait()
+}
+
+// InFlight counts the indexer searches and SABnzbd submissions running right now.
+type InFlight struct {
+	Searches  atomic.Int64
+	Downloads atomic.Int64
 }
 
 type Config struct {
-	DownloadDir   string
-	DataDir       string
-	NewsNabHost   string
-	NewsNabApiKey string
+	File        string
+	DownloadDir string
+	MoviesDir   string
+	EpisodesDir string
+	DataDir     string
+	TokenFile   string
+
+	TraktClientSecret string
+	NewsNabHost       string
+	NewsNabApiKey     string
+
+	NotifyDedupWindow time.Duration
+	SlowCallThreshold time.Duration
+	NZBAllowedHosts   []string
+	ShutdownTimeout   time.Duration
+
+	MaxConcurrentDownloads      int
+	UntaggedRemuxMinSize        int64
+	SyncInterval                time.Duration
+	ParallelSync                bool
+	SearchBackoff               time.Duration
+	SearchBackoffMax            time.Duration
+	CleanupMode                 string
+	NewsNabJSON                 bool
+	EpisodeTitleInSearch        bool
+	TokenClockSkew              time.Duration
+	TasksBusyMode               string
+	HealthSweepInterval         time.Duration
+	HealthSweepBatch            int
+	MaxEpisodesPerShow          int
+	AdminToken                  string
+	MovieSearchInterval         time.Duration
+	EpisodeSearchInterval       time.Duration
+	SearchOnAdd                 bool
+	CleanupFreeSpaceTarget      int64
+	NewsNabMovieCategories      []string
+	NewsNabTVCategories         []string
+	NewsNabExcludedCategories   []string
+	MinReleaseAge               time.Duration
+	HistoryWindow               time.Duration
+	HistoryMaxItems             int
+	AvoidRetriedReleases        bool
+	NewsNabMaxResponseSize      int64
+	SMTPHost                    string
+	SMTPPort                    int
+	SMTPUser                    string
+	SMTPPass                    string
+	SMTPFrom                    string
+	SMTPTo                      []string
+	DigestInterval              time.Duration
+	ShowIDRemap                 map[int64]int64
+	RequireHealthyIndexer       bool
+	CORSAllowedOrigins          []string
+	TraktDeviceReauth           bool
+	MaxFilenameLength           int
+	RetainAcquisitions          bool
+	AllowMissingIMDB            bool
+	CompletedMinSizePercent     int
+	RunSummaryMail              bool
+	EpisodeSourcePrecedence     string
+	PreferredEdition            string
+	DBOpenTimeout               time.Duration
+	WebhookURL                  string
+	WebhookRetries              int
+	WebhookTimeout              time.Duration
+	NewsNabJSONMaxFailures      int
+	MaxEpisodesPerShowOverrides map[int64]int64
 }
 
 type Media struct {
-	Trakt      int64 `boltholdIndex:"Trakt"`
-	IMDB       string
-	Number     int64
-	Season     int64
-	Title      string
-	Year       int64
-	OnDisk     bool
-	File       string
-	DownloadID string
+	Trakt          int64     `boltholdIndex:"Trakt" json:"trakt"`
+	TMDB           int64     `json:"tmdb,omitempty"`
+	TVDB           int64     `json:"tvdb,omitempty"`
+	IMDB           string    `json:"imdb"`
+	Show           int64     `json:"show,omitempty"`
+	Number         int64     `json:"number,omitempty"`
+	Season         int64     `json:"season,omitempty"`
+	Title          string    `json:"title"`
+	Year           int64     `json:"year"`
+	OnDisk         bool      `json:"on_disk"`
+	File           string    `json:"file"`
+	DownloadID     string    `json:"download_id"`
+	TriedReleases  []string  `json:"tried_releases,omitempty"`
+	DownloadedAt   time.Time `json:"downloaded_at"`
+	DownloadStatus string    `json:"download_status,omitempty"`
+	Edition        string    `json:"edition,omitempty"`
+	Tags           []string  `json:"tags"`
+	WatchedAt      time.Time `json:"watched_at"`
+
+	LastSearchAt  time.Time `json:"last_search_at"`
+	EmptySearches int       `json:"empty_searches"`
+}
+
+func (media Media) IsMovie() bool {
+	return media.Number == 0 && media.Season == 0
+}
+
+type ArchivedMedia struct {
+	Media
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+type ShowProgress struct {
+	Show    int64     `json:"show"`
+	Season  int64     `json:"season"`
+	Number  int64     `json:"number"`
+	ResetAt time.Time `json:"reset_at"`
 }
 
 type NZB struct {
-	Trakt  int64 `boltholdIndex:"Trakt"`
-	Link   string
-	Length int64
-	Title  string
-	Failed bool
+	GUID     string    `boltholdKey:"GUID" json:"guid"`
+	Trakt    int64     `boltholdIndex:"Trakt" json:"trakt"`
+	Link     string    `json:"link"`
+	Length   int64     `json:"length"`
+	Title    string    `json:"title"`
+	Failed   bool      `json:"failed"`
+	FailedAt time.Time `json:"failed_at,omitempty"`
 }
 
 type Failure struct {
@@ -46,6 +206,11 @@ type Failure struct {
 	Message string `json:"message"`
 }
 
+type Notification struct {
+	Key        string    `json:"key"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
 type Success struct {
 	Name     string `json:"name"`
 	Id       string `json:"id"`
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	EventMediaAdded        = "media.added"
+	EventDownloadStarted   = "download.started"
+	EventDownloadCompleted = "download.completed"
+	EventDownloadFailed    = "download.failed"
+	EventMediaDeleted      = "media.deleted"
+)
+
+type WebhookEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Trakt   int64     `json:"trakt"`
+	IMDB    string    `json:"imdb,omitempty"`
+	Show    int64     `json:"show,omitempty"`
+	Season  int64     `json:"season,omitempty"`
+	Number  int64     `json:"number,omitempty"`
+	Title   string    `json:"title"`
+	Year    int64     `json:"year,omitempty"`
+	File    string    `json:"file,omitempty"`
+	Release string    `json:"release,omitempty"`
+}
+
+// emit posts event for media to WEBHOOK_URL in the background. It does nothing when
+// WEBHOOK_URL is not set.
+func (app App) emit(event string, media Media, release string) {
+	if app.Config().WebhookURL == "" {
+		return
+	}
+	payload := WebhookEvent{
+		Event:   event,
+		Time:    time.Now(),
+		Trakt:   media.Trakt,
+		IMDB:    media.IMDB,
+		Show:    media.Show,
+		Season:  media.Season,
+		Number:  media.Number,
+		Title:   media.Title,
+		Year:    media.Year,
+		File:    media.File,
+		Release: release,
+	}
+	if !app.Tasks.Start() {
+		log.WithFields(log.Fields{
+			"event": event,
+			"media": media.Trakt,
+		}).Warning("Shutting down, not sending webhook")
+		return
+	}
+	go func() {
+		defer app.Tasks.Done()
+		// Cancelled on shutdown, so retries don't hold it up past SHUTDOWN_TIMEOUT
+		if err := app.Config().postWebhook(app.Tasks.Context(), payload); err != nil {
+			log.WithFields(log.Fields{
+				"event": event,
+				"media": media.Trakt,
+				"err":   err,
+			}).Error("sending webhook")
+		}
+	}()
+}
+
+// postWebhook posts the event, retrying up to WEBHOOK_RETRIES times on errors and
+// non-2xx responses.
+func (config Config) postWebhook(ctx context.Context, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding event: %v", err)
+	}
+	for attempt := 0; ; attempt++ {
+		err = config.sendWebhook(ctx, body)
+		if err == nil || attempt >= config.WebhookRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		}
+	}
+}
+
+func (config Config) sendWebhook(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, config.WebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPostWebhookSendsEvent(t *testing.T) {
+	var received WebhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	config := Config{WebhookURL: server.URL, WebhookTimeout: time.Second}
+	event := WebhookEvent{Event: EventDownloadCompleted, Trakt: 42, Title: "Movie", Release: "Movie.2010.1080p"}
+	if err := config.postWebhook(context.Background(), event); err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+	if received.Event != EventDownloadCompleted || received.Trakt != 42 || received.Release != "Movie.2010.1080p" {
+		t.Errorf("received %+v, want %+v", received, event)
+	}
+}
+
+func TestPostWebhookRetriesOnError(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	config := Config{WebhookURL: server.URL, WebhookTimeout: time.Second, WebhookRetries: 1}
+	if err := config.postWebhook(context.Background(), WebhookEvent{Event: EventMediaAdded}); err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("%d calls, want 2", got)
+	}
+
+	config.WebhookRetries = 0
+	calls.Store(0)
+	if err := config.postWebhook(context.Background(), WebhookEvent{Event: EventMediaAdded}); err == nil {
+		t.Error("postWebhook succeeded on a 502 without retries")
+	}
+}
+
+func TestShutdownStopsWebhookRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	app := newTestApp(t, Config{WebhookURL: server.URL, WebhookTimeout: time.Second, WebhookRetries: 10})
+
+	app.emit(EventMediaAdded, Media{Trakt: 1}, "")
+	for deadline := time.Now().Add(5 * time.Second); calls.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("webhook never sent")
+		}
+	}
+	start := time.Now()
+	app.Tasks.Close()
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("shutdown waited %v for the webhook retries", waited)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("%d webhook attempts, want the retries stopped after 1", got)
+	}
+}